@@ -1,23 +1,29 @@
 package archive
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"crypto"
-	"crypto/sha512"
 
 	"golang.org/x/crypto/openpgp"
-	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/armor"
 	"golang.org/x/crypto/openpgp/packet"
 
 	"pault.ag/go/blobstore"
 	"pault.ag/go/debian/control"
+	"pault.ag/go/debian/deb"
 	"pault.ag/go/debian/dependency"
 	"pault.ag/go/debian/hashio"
+	"pault.ag/go/debian/version"
 )
 
 // Archive {{{
@@ -25,10 +31,41 @@ import (
 // Core Archive abstrcation. This contains helpers to write out package files,
 // as well as handles creating underlying abstractions (such as Suites).
 type Archive struct {
-	Store      blobstore.Store
-	signingKey *openpgp.Entity
-	path       string
-	Pool       Pool
+	Store   blobstore.Store
+	signers []Signer
+	path    string
+	Pool    Pool
+
+	// If set, the OpenPGP signatures over the Release files will expire
+	// after this long, so even a captured signature stops being accepted by
+	// clients which check signature expiry once the window has passed. It's
+	// rounded up to a whole number of seconds.
+	SignatureLifetime time.Duration
+
+	// Hash algorithm used for the OpenPGP signatures over the Release files,
+	// one of SHA224, SHA256, SHA384 or SHA512. The default value of 0 means
+	// SHA512.
+	SignatureHash crypto.Hash
+
+	// If the signing key is protected by a passphrase, Passphrase is called
+	// to get it the first time something is signed. It is not called at all
+	// if nothing is signed, or the signing key is not protected.
+	Passphrase func() ([]byte, error)
+
+	// Clock returns the current time, which is used for the Date and
+	// Valid-Until of the Release files, and the creation time of their
+	// OpenPGP signatures. The default value of nil means time.Now is used;
+	// it can be set to a fixed time (such as SOURCE_DATE_EPOCH) to build
+	// reproducible Archives.
+	Clock func() time.Time
+}
+
+// now returns the current time, as given by Clock.
+func (a Archive) now() time.Time {
+	if a.Clock != nil {
+		return a.Clock()
+	}
+	return time.Now()
 }
 
 // Create a new Archive at the given `root` on the filesystem, with the
@@ -39,6 +76,33 @@ type Archive struct {
 // steps must be taken to load an Archive over the network, and attention
 // must be paid when handling the Cryptographic chain of trust.
 func New(path string, signer *openpgp.Entity) (*Archive, error) {
+	signers := []*openpgp.Entity{}
+	if signer != nil {
+		signers = append(signers, signer)
+	}
+	return NewWithSigners(path, signers)
+}
+
+// Like New, but the Release files are signed by every one of the given
+// openpgp.Entity `signers`. This is useful during a key rotation, so clients
+// that trust either the outgoing or the incoming key can verify the Release.
+// Every one of the `signers` must contain its OpenPGP Private Key.
+func NewWithSigners(path string, signers []*openpgp.Entity) (*Archive, error) {
+	wrapped := []Signer{}
+	for _, signer := range signers {
+		if signer == nil || signer.PrivateKey == nil {
+			return nil, fmt.Errorf("Signing key has no Private Key")
+		}
+		wrapped = append(wrapped, entitySigner{entity: signer})
+	}
+	return NewFromSigners(path, wrapped)
+}
+
+// Like NewWithSigners, but the Release files are signed by the given
+// Signers, rather than by in-memory OpenPGP Private Keys. This allows the
+// signing key to live somewhere else entirely, such as on a smartcard, in an
+// HSM, or behind gpg-agent.
+func NewFromSigners(path string, signers []Signer) (*Archive, error) {
 	var err error
 	path, err = filepath.Abs(path)
 	if err != nil {
@@ -51,10 +115,10 @@ func New(path string, signer *openpgp.Entity) (*Archive, error) {
 	}
 
 	return &Archive{
-		Store:      *store,
-		signingKey: signer,
-		path:       path,
-		Pool:       Pool{Store: *store},
+		Store:   *store,
+		signers: signers,
+		path:    path,
+		Pool:    Pool{Store: *store},
 	}, nil
 }
 
@@ -71,23 +135,72 @@ func (a Archive) GC() error {
 	return a.Store.GC(blobstore.DumbGarbageCollector{})
 }
 
+// Like GC, but also keep the given objects around, even if they're not
+// linked anywhere.
+//
+// This is useful when a publish is in flight, and freshly committed objects
+// (such as those returned by Engross) have not yet been passed to Link.
+func (a Archive) DecruftExcept(keep []blobstore.Object) error {
+	collector := keepGarbageCollector{}
+	for _, obj := range keep {
+		collector[obj.Id()] = true
+	}
+	return a.Store.GC(collector)
+}
+
+// GarbageCollector which collects every object that's not linked, like the
+// blobstore.DumbGarbageCollector, except for those in the set, by id.
+type keepGarbageCollector map[string]bool
+
+func (k keepGarbageCollector) Collect(store blobstore.Store, obj blobstore.Object, linked bool) (bool, error) {
+	return !linked && !k[obj.Id()], nil
+}
+
 // Given a list of objects, link them to the keyed paths.
+//
+// The signed Release files are linked last, after every index they list, so
+// a client that fetches the Release while this is going on never sees it
+// refer to an index that isn't there yet; see linkOrder.
 func (a Archive) Link(blobs ArchiveState) error {
-	for path, obj := range blobs {
-		if err := a.Store.Link(obj, path); err != nil {
+	for _, path := range linkOrder(blobs) {
+		if err := a.Store.Link(blobs[path], path); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// Rank of the files of a Suite which must be linked after everything else,
+// in the order they're linked, by file name.
+var releaseLinkRank = map[string]int{
+	"Release":     1,
+	"Release.gpg": 2,
+	"InRelease":   3,
+}
+
+// Get the paths of the ArchiveState in the order Link links them: sorted,
+// except for the Release, Release.gpg and InRelease files, which come last
+// (in that order).
+func linkOrder(blobs ArchiveState) []string {
+	paths := []string{}
+	for filePath := range blobs {
+		paths = append(paths, filePath)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		ri, rj := releaseLinkRank[path.Base(paths[i])], releaseLinkRank[path.Base(paths[j])]
+		if ri != rj {
+			return ri < rj
+		}
+		return paths[i] < paths[j]
+	})
+	return paths
+}
+
 // Create a new Release object from a Suite, passing off the Name, Description
-// and constructing the rest of the goodies.
+// and constructing the rest of the goodies, dated `when`.
 //
 // This will be an entirely empty object, without anything read off disk.
-func newRelease(suite Suite) (*Release, error) {
-	when := time.Now()
-
+func newRelease(suite Suite, when time.Time) (*Release, error) {
 	var validUntil string = ""
 	if suite.features.Duration != "" {
 		duration, err := time.ParseDuration(suite.features.Duration)
@@ -99,19 +212,40 @@ func newRelease(suite Suite) (*Release, error) {
 
 	release := Release{
 		Suite:       suite.Name,
+		Codename:    suite.Codename,
 		Description: suite.Description,
 		ValidUntil:  validUntil,
 		Origin:      suite.Origin,
 		Label:       suite.Label,
 		Version:     suite.Version,
+
+		AcquireByHash: suite.features.AcquireByHash,
+	}
+	if suite.features.NotAutomatic {
+		release.NotAutomatic = "yes"
+	}
+	if suite.features.ButAutomaticUpgrades {
+		release.ButAutomaticUpgrades = "yes"
 	}
 	release.Date = when.In(time.UTC).Format(time.RFC1123Z)
 	release.Architectures = []dependency.Arch{}
 	release.Components = []string{}
-	release.SHA256 = []control.SHA256FileHash{}
-	release.SHA1 = []control.SHA1FileHash{}
-	release.SHA512 = []control.SHA512FileHash{}
-	release.MD5Sum = []control.MD5FileHash{}
+
+	// Only the hash blocks of the Suite's Hashes are set, so the others
+	// (such as the deprecated MD5Sum and SHA1) are left out of the Release
+	// entirely.
+	for _, algorithm := range suite.features.Hashes {
+		switch normalizeHashName(algorithm) {
+		case "sha256":
+			release.SHA256 = []control.SHA256FileHash{}
+		case "sha1":
+			release.SHA1 = []control.SHA1FileHash{}
+		case "sha512":
+			release.SHA512 = []control.SHA512FileHash{}
+		case "md5":
+			release.MD5Sum = []control.MD5FileHash{}
+		}
+	}
 	return &release, nil
 }
 
@@ -127,157 +261,213 @@ type ArchiveState map[string]blobstore.Object
 //
 // This will contain all the related Packages and Release files.
 func (a Archive) Engross(suite Suite) (ArchiveState, error) {
-	release, err := newRelease(suite)
+	release, err := newRelease(suite, a.now())
 	if err != nil {
 		return nil, err
 	}
 
 	files := ArchiveState{}
-	arches := map[dependency.Arch]bool{}
+	arches := map[string]dependency.Arch{}
+
+	// Components, and the Architectures of each, are walked in sorted order,
+	// so the Release comes out the same no matter what order they were
+	// created in.
+	names := []string{}
+	for name := range suite.components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	for name, component := range suite.components {
+	for _, name := range names {
+		component := suite.components[name]
 		release.Components = append(release.Components, name)
-		for arch, writer := range component.packageWriters {
-			arches[arch] = true
 
-			// For each Binary entry, do the same as above (todo: someone
-			// DRY this out a bit. I'm too lazy.
+		indexComponent := component
+		if component.alias != "" {
+			target, ok := suite.components[component.alias]
+			if !ok || target.alias != "" {
+				return nil, fmt.Errorf(
+					"Component '%s' is an alias of unknown Component '%s'",
+					name, component.alias,
+				)
+			}
+			indexComponent = target
+		}
+		writers := indexComponent.packageWriters
+		sourceWriter := indexComponent.sourceWriter
 
-			suitePath := path.Join(name, fmt.Sprintf("binary-%s", arch),
-				"Packages")
+		if sourceWriter != nil {
+			suitePath := sourceIndexPath(name)
+			if err := sourceWriter.engross(suite.Name, suitePath, release, files); err != nil {
+				return nil, err
+			}
+		}
 
-			obj, err := a.Store.Commit(*writer.handle)
-			if err != nil {
+		for _, arch := range indexComponent.Architectures() {
+			arches[arch.String()] = arch
+
+			suitePath := binaryIndexPath(name, arch)
+			if err := writers[arch].engross(suite.Name, suitePath, release, files); err != nil {
 				return nil, err
 			}
+		}
 
-			for _, hasher := range writer.hashers {
-				fileHash := control.FileHashFromHasher(suitePath, *hasher)
-				release.AddHash(fileHash)
+		if indexComponent.RecordContents {
+			for _, arch := range indexComponent.Architectures() {
+				suitePath := contentsPath(name, arch)
+				writer := indexComponent.contentsWriter(arch)
+				if err := writer.engross(suite.Name, suitePath, release, files); err != nil {
+					return nil, err
+				}
 			}
+		}
 
-			filePath := path.Join("dists", suite.Name, suitePath)
-			files[filePath] = *obj
+		if indexComponent.RecordTranslations {
+			writer, err := newIndexWriter(&suite)
+			if err != nil {
+				return nil, err
+			}
+			for _, translation := range englishTranslations(writers) {
+				if err := writer.Add(translation); err != nil {
+					return nil, err
+				}
+			}
+			suitePath := translationPath(name, "en")
+			if err := writer.engross(suite.Name, suitePath, release, files); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	for arch, _ := range arches {
+	for _, arch := range arches {
 		release.Architectures = append(release.Architectures, arch)
 	}
+	sortArches(release.Architectures)
+	release.sortHashes()
 
 	/* Now, let's do some magic */
 
-	// Now, let's write out the Release file (and sign it normally)
-	obj, sig, err := suite.archive.encodeSigned(release)
+	// The Release is encoded once, and the same bytes are used for both the
+	// Release and InRelease files.
+	encoded, err := encodeBytes(release)
 	if err != nil {
 		return nil, err
 	}
 
-	filePath := path.Join("dists", suite.Name, "Release")
-	files[filePath] = *obj
-	files[fmt.Sprintf("%s.gpg", filePath)] = *sig
+	// Now, let's write out the Release file (and sign it normally)
+	if suite.features.DetachedRelease {
+		obj, sig, err := a.signedObjects(encoded)
+		if err != nil {
+			return nil, err
+		}
 
-	// Ditto with the clearsigned version (Should we merge the two above?)
-	obj, err = suite.archive.encodeClearsigned(release)
-	if err != nil {
-		return nil, err
+		filePath := suiteFilePath(suite.Name, "Release")
+		files[filePath] = *obj
+		files[fmt.Sprintf("%s.gpg", filePath)] = *sig
 	}
 
-	files[path.Join("dists", suite.Name, "InRelease")] = *obj
+	// Ditto with the clearsigned version (Should we merge the two above?)
+	if suite.features.InRelease {
+		obj, err := a.clearsignedObject(encoded)
+		if err != nil {
+			return nil, err
+		}
+
+		files[suiteFilePath(suite.Name, "InRelease")] = *obj
+	}
 
 	return files, nil
 }
 
-// Given a control.Marshal'able object, encode it to the blobstore, while
-// also clearsigning the data.
-func (a Archive) encodeClearsigned(data interface{}) (*blobstore.Object, error) {
+// Get the path of the Packages index for the given Component and
+// Architecture, relative to the directory of the Suite (such as
+// "main/binary-amd64/Packages"). This is the path used in the hash blocks of
+// the Release file.
+func binaryIndexPath(component string, arch dependency.Arch) string {
+	return path.Join(component, fmt.Sprintf("binary-%s", arch), "Packages")
+}
 
-	if a.signingKey == nil {
-		return nil, fmt.Errorf("No signing key loaded")
-	}
+// Get the path of the Sources index for the given Component, relative to the
+// directory of the Suite (such as "main/source/Sources").
+func sourceIndexPath(component string) string {
+	return path.Join(component, "source", "Sources")
+}
 
-	fd, err := a.Store.Create()
-	if err != nil {
-		return nil, err
-	}
+// Get the path of the Contents index for the given Component and
+// Architecture, relative to the directory of the Suite (such as
+// "main/Contents-amd64").
+func contentsPath(component string, arch dependency.Arch) string {
+	return path.Join(component, fmt.Sprintf("Contents-%s", arch))
+}
 
-	defer fd.Close()
-	wc, err := clearsign.Encode(fd, a.signingKey.PrivateKey, &packet.Config{
-		DefaultHash: crypto.SHA512,
-	})
-	if err != nil {
-		return nil, err
-	}
+// Given a path relative to the directory of the Suite (such as the paths
+// listed in the Release file), get the path relative to the root of the
+// archive (such as "dists/unstable/main/binary-amd64/Packages").
+func suiteFilePath(suite string, suitePath string) string {
+	return path.Join("dists", suite, suitePath)
+}
 
-	encoder, err := control.NewEncoder(wc)
+// Given already encoded data (see encodeBytes), write it to the blobstore,
+// while also clearsigning the data.
+func (a Archive) clearsignedObject(encoded []byte) (*blobstore.Object, error) {
+	fd, err := a.Store.Create()
 	if err != nil {
 		return nil, err
 	}
 
-	if err := encoder.Encode(data); err != nil {
-		return nil, err
-	}
+	defer fd.Close()
 
-	if err := wc.Close(); err != nil {
+	if err := a.clearsign(fd, encoded); err != nil {
 		return nil, err
 	}
 
 	return a.Store.Commit(*fd)
 }
 
-// Given a control.Marshal'able object, encode it to the blobstore, while
-// also doing a detached OpenPGP signature. The objects returned (in order)
-// are data, commited to the blobstore, the signature for that object, commited
-// to the blobstore, and any error(s), finally.
-func (a Archive) encodeSigned(data interface{}) (*blobstore.Object, *blobstore.Object, error) {
-	/* Right, so, the trick here is that we secretly call out to encode,
-	 * but tap it with a pipe into the signing code */
-
-	if a.signingKey == nil {
-		return nil, nil, fmt.Errorf("No signing key loaded")
-	}
-
+// Given already encoded data (see encodeBytes), write it to the blobstore,
+// while also doing a detached OpenPGP signature. The objects returned (in
+// order) are data, commited to the blobstore, the signature for that object,
+// ASCII armored (as Debian's Release.gpg is, and as LoadRelease expects),
+// commited to the blobstore, and any error(s), finally.
+func (a Archive) signedObjects(encoded []byte) (*blobstore.Object, *blobstore.Object, error) {
 	signature, err := a.Store.Create()
 	if err != nil {
 		return nil, nil, err
 	}
 	defer signature.Close()
 
-	hash := sha512.New()
-
-	obj, err := a.encode(data, hash)
+	armored, err := armor.Encode(signature, openpgp.SignatureType, nil)
 	if err != nil {
 		return nil, nil, err
 	}
+	if err := a.sign(armored, packet.SigTypeBinary, encoded); err != nil {
+		return nil, nil, err
+	}
+	if err := armored.Close(); err != nil {
+		return nil, nil, err
+	}
 
-	sig := new(packet.Signature)
-	sig.SigType = packet.SigTypeBinary
-	sig.PubKeyAlgo = a.signingKey.PrivateKey.PubKeyAlgo
-
-	sig.Hash = crypto.SHA512
-
-	sig.CreationTime = new(packet.Config).Now()
-	sig.IssuerKeyId = &(a.signingKey.PrivateKey.KeyId)
-
-	err = sig.Sign(hash, a.signingKey.PrivateKey, &packet.Config{
-		DefaultHash: crypto.SHA512,
-	})
+	sigObj, err := a.Store.Commit(*signature)
+	if err != nil {
+		return nil, nil, err
+	}
 
+	fd, err := a.Store.Create()
 	if err != nil {
 		return nil, nil, err
 	}
+	defer fd.Close()
 
-	if err := sig.Serialize(signature); err != nil {
+	if _, err := fd.Write(encoded); err != nil {
 		return nil, nil, err
 	}
 
-	sigObj, err := a.Store.Commit(*signature)
+	obj, err := a.Store.Commit(*fd)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	return obj, sigObj, nil
-
 }
 
 // Encode a given control.Marshal'able object into the Blobstore, and return
@@ -297,16 +487,37 @@ func (a Archive) encode(data interface{}, tap io.Writer) (*blobstore.Object, err
 		writer = io.MultiWriter(fd, tap)
 	}
 
-	encoder, err := control.NewEncoder(writer)
-	if err != nil {
+	if err := encodeControl(writer, data); err != nil {
 		return nil, err
 	}
 
-	if err := encoder.Encode(data); err != nil {
+	return a.Store.Commit(*fd)
+}
+
+// Encode a given control.Marshal'able object into memory, so that the same
+// encoding can be written out more than once (such as when writing both the
+// Release and InRelease files) without encoding it again.
+func encodeBytes(data interface{}) ([]byte, error) {
+	buf := bytes.Buffer{}
+	if err := encodeControl(&buf, data); err != nil {
 		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	return a.Store.Commit(*fd)
+// Encode a given control.Marshal'able object to the io.Writer. If the object
+// knows how to Encode itself (such as a Release), that's used instead of a
+// control.Encoder.
+func encodeControl(out io.Writer, data interface{}) error {
+	if encodable, ok := data.(interface{ Encode(io.Writer) error }); ok {
+		return encodable.Encode(out)
+	}
+
+	encoder, err := control.NewEncoder(out)
+	if err != nil {
+		return err
+	}
+	return encoder.Encode(data)
 }
 
 // }}}
@@ -316,13 +527,15 @@ func (a Archive) encode(data interface{}, tap io.Writer) (*blobstore.Object, err
 // Abstraction to handle writing data into a Suite. This is a write-only
 // target, and is not intended to read a Release file.
 //
-// This contains no state read off disk, and is purely for writing to.
+// This contains no state read off disk, and is purely for writing to, unless
+// it was read back from the Archive with OpenSuite.
 type Suite struct {
 	control.Paragraph
 
 	archive *Archive
 
 	Name        string `control:"Suite"`
+	Codename    string
 	Description string
 	Origin      string
 	Label       string
@@ -331,23 +544,38 @@ type Suite struct {
 	components map[string]*Component `control:"-"`
 
 	features struct {
-		Hashes   []string
-		Duration string
+		Hashes       []string
+		Compressions []string
+		Duration     string
+
+		InRelease       bool
+		DetachedRelease bool
+
+		AcquireByHash bool
+
+		NotAutomatic         bool
+		ButAutomaticUpgrades bool
 	} `control:"-"`
 }
 
 // Get a handle to write a given Suite from an Archive.
 // The suite will be entirely blank, and attributes will not be
 // read from the existing files, if any.
-func (a Archive) Suite(name string) (*Suite, error) {
+//
+// The Suite refers back to this Archive, so options set on the Archive
+// afterwards (such as Clock) still apply to it.
+func (a *Archive) Suite(name string) (*Suite, error) {
 	suite := Suite{
 		Name:       name,
-		archive:    &a,
+		archive:    a,
 		components: map[string]*Component{},
 	}
 
 	suite.features.Hashes = []string{"sha256", "sha1", "sha512"}
+	suite.features.Compressions = []string{"gz", "xz"}
 	suite.features.Duration = "168h"
+	suite.features.InRelease = true
+	suite.features.DetachedRelease = true
 
 	return &suite, nil
 }
@@ -357,9 +585,9 @@ func (a Archive) Suite(name string) (*Suite, error) {
 // it will return the existing entry.
 //
 // This contains no state read off disk, and is purely for writing to.
-func (s Suite) Component(name string) (*Component, error) {
+func (s *Suite) Component(name string) (*Component, error) {
 	if _, ok := s.components[name]; !ok {
-		comp, err := newComponent(&s)
+		comp, err := newComponent(s, name)
 		if err != nil {
 			return nil, err
 		}
@@ -370,6 +598,128 @@ func (s Suite) Component(name string) (*Component, error) {
 	return el, nil
 }
 
+// Declare that the Component `name` contains exactly the same indices as the
+// Component `target`. When engrossed, the indices written for `target` are
+// linked into place for `name` as well, so they're only written and hashed
+// once.
+//
+// An aliased Component can not have packages added to it directly.
+func (s *Suite) AliasComponent(name, target string) error {
+	if name == target {
+		return fmt.Errorf("Component '%s' can not be an alias of itself", name)
+	}
+	comp, err := s.Component(name)
+	if err != nil {
+		return err
+	}
+	if len(comp.packageWriters) != 0 {
+		return fmt.Errorf("Component '%s' already has packages", name)
+	}
+	comp.alias = target
+	return nil
+}
+
+// Set which signed Release files are written out by Engross; inRelease for
+// the clearsigned InRelease, and detached for the Release file with its
+// detached signature in Release.gpg. Both are written by default.
+//
+// Each of these is signed separately, so only the ones asked for are signed,
+// and writing InRelease alone makes one signature per signer rather than two
+// (see BenchmarkEngrossSignatureFiles). For a Release of about 1.4 MB signed
+// with a 2048 bit RSA key, that is about 5.5ms of the 14ms spent signing on
+// every Engross. Modern clients only need InRelease.
+func (s *Suite) SetSignatureFiles(inRelease, detached bool) error {
+	if !inRelease && !detached {
+		return fmt.Errorf("At least one of InRelease or Release must be written")
+	}
+	s.features.InRelease = inRelease
+	s.features.DetachedRelease = detached
+	return nil
+}
+
+// Set the hash algorithms used for the indices of the Suite, which are the
+// only hash blocks written into the Release, and the only hashes computed.
+// Each is one of "md5", "sha1", "sha256" or "sha512", and "sha256" is
+// required, since apt requires it. By default, "sha256", "sha1" and
+// "sha512" are used.
+func (s *Suite) SetHashes(hashes ...string) error {
+	hasSHA256 := false
+	for _, algorithm := range hashes {
+		switch normalizeHashName(algorithm) {
+		case "sha256":
+			hasSHA256 = true
+		case "md5", "sha1", "sha512":
+		default:
+			return fmt.Errorf("Unknown hash: '%s'", algorithm)
+		}
+	}
+	if !hasSHA256 {
+		return fmt.Errorf("The sha256 hash is required")
+	}
+	s.features.Hashes = hashes
+	return nil
+}
+
+// Set the compressed variants written alongside every Packages and Sources
+// index of the Suite, by the name of the compression (one of "gz" or "xz"),
+// such as Packages.gz and Packages.xz. The uncompressed index is always
+// written. By default, both "gz" and "xz" variants are written.
+func (s *Suite) SetCompressions(compressions ...string) error {
+	for _, compression := range compressions {
+		if _, ok := indexCompressors[compression]; !ok {
+			return fmt.Errorf("Unknown compression: '%s'", compression)
+		}
+	}
+	s.features.Compressions = compressions
+	return nil
+}
+
+// Set the NotAutomatic and ButAutomaticUpgrades fields of the Release, as
+// used by suites such as experimental (NotAutomatic), or backports (both),
+// whose packages apt should not install unless asked to. Neither is set by
+// default.
+//
+// ButAutomaticUpgrades without NotAutomatic is invalid, and is an error.
+func (s *Suite) SetAutomatic(notAutomatic, butAutomaticUpgrades bool) error {
+	if butAutomaticUpgrades && !notAutomatic {
+		return fmt.Errorf("ButAutomaticUpgrades requires NotAutomatic")
+	}
+	s.features.NotAutomatic = notAutomatic
+	s.features.ButAutomaticUpgrades = butAutomaticUpgrades
+	return nil
+}
+
+// Set whether every index of the Suite is also written out at a by-hash path
+// for each of its hashes (such as "main/binary-amd64/by-hash/SHA256/<hash>"),
+// and the Release says so with "Acquire-By-Hash: yes". This lets clients
+// fetch indices which match the Release they have, even while the Suite is
+// being updated. This is off by default.
+//
+// Old by-hash files are left in place when the Suite is updated, since
+// clients may still have an older Release; see PruneByHash.
+func (s *Suite) SetAcquireByHash(acquireByHash bool) {
+	s.features.AcquireByHash = acquireByHash
+}
+
+// Get the list of Architectures that any Component of this Suite has had
+// packages added for so far. This reflects what will be written out by
+// Engross, not any declared list of Architectures.
+func (s Suite) Architectures() []dependency.Arch {
+	seen := map[string]bool{}
+	ret := []dependency.Arch{}
+	for _, component := range s.components {
+		for _, arch := range component.Architectures() {
+			if seen[arch.String()] {
+				continue
+			}
+			seen[arch.String()] = true
+			ret = append(ret, arch)
+		}
+	}
+	sortArches(ret)
+	return ret
+}
+
 // }}}
 
 // Component {{{
@@ -380,17 +730,74 @@ func (s Suite) Component(name string) (*Component, error) {
 // This contains no state read off disk, and is purely for writing to.
 type Component struct {
 	suite          *Suite
+	name           string
 	packageWriters map[dependency.Arch]*IndexWriter
+	sourceWriter   *SourceWriter
+	alias          string
+
+	// Set of packages added so far, keyed by packageKey, used to catch the
+	// same package being added twice.
+	packages map[string]bool
+
+	// Set of sources added so far, keyed by sourceKey, likewise.
+	sources map[string]bool
+
+	// If set, AddDeb will record the list of files in each .deb added, and
+	// Engross will write out a Contents-<arch> index for this Component.
+	//
+	// This keeps every path of every .deb added in memory until the Suite is
+	// engrossed, which may be quite large for big Components, so it's only
+	// done when asked for.
+	RecordContents bool
+
+	// If set, AddPackage will set the Description-md5 of each Package added
+	// (if it has none), and Engross will write out an i18n/Translation-en
+	// index for this Component, holding the Description of each Package,
+	// keyed by its Description-md5. This must be set before any Package is
+	// added.
+	RecordTranslations bool
+
+	// Packages (as "section/package") which contain each path, by
+	// Architecture, recorded by AddDeb if RecordContents is set.
+	contents map[dependency.Arch]map[string][]string
+
+	// Writers for the Contents index of each Architecture, so that it's
+	// only written once, even if this Component is aliased.
+	contentsWriters map[dependency.Arch]*IndexWriter
 }
 
 // Create a new Component, configured for use.
-func newComponent(suite *Suite) (*Component, error) {
+func newComponent(suite *Suite, name string) (*Component, error) {
 	return &Component{
-		suite:          suite,
-		packageWriters: map[dependency.Arch]*IndexWriter{},
+		suite:           suite,
+		name:            name,
+		packageWriters:  map[dependency.Arch]*IndexWriter{},
+		packages:        map[string]bool{},
+		sources:         map[string]bool{},
+		contents:        map[dependency.Arch]map[string][]string{},
+		contentsWriters: map[dependency.Arch]*IndexWriter{},
 	}, nil
 }
 
+// Get the Pool of the Archive, set up to include files into the pool
+// directory of this Component (pool/<component>/...), so the .debs and
+// sources added to this Component can be included there first. The Pool of
+// an aliased Component is that of its target.
+func (c *Component) Pool() Pool {
+	pool := c.suite.archive.Pool
+	pool.Component = c.name
+	if c.alias != "" {
+		pool.Component = c.alias
+	}
+	return pool
+}
+
+// Get the key that identifies a Package within a Component; no two Packages
+// in a Component may have the same name, version and Architecture.
+func packageKey(pkg Package) string {
+	return fmt.Sprintf("%s_%s_%s", pkg.Package, pkg.Version, pkg.Architecture)
+}
+
 // Get a given IndexWriter for an arch, or create one if none exists.
 func (c *Component) getWriter(arch dependency.Arch) (*IndexWriter, error) {
 	if _, ok := c.packageWriters[arch]; !ok {
@@ -403,15 +810,278 @@ func (c *Component) getWriter(arch dependency.Arch) (*IndexWriter, error) {
 	return c.packageWriters[arch], nil
 }
 
+// Declare that this Component has packages for the given Architectures, even
+// if none have been added for some of them. An empty (but valid) Packages
+// index is written out for each Architecture that has no packages, so the
+// Component is advertised in the Release before it has any packages.
+func (c *Component) AddArchitectures(arches ...dependency.Arch) error {
+	if c.alias != "" {
+		return fmt.Errorf("Component is an alias of '%s'", c.alias)
+	}
+	for _, arch := range arches {
+		if _, err := c.getWriter(arch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the list of Architectures that this Component has had packages added
+// for so far (or that were declared with AddArchitectures), sorted by name.
+func (c *Component) Architectures() []dependency.Arch {
+	ret := []dependency.Arch{}
+	for arch := range c.packageWriters {
+		ret = append(ret, arch)
+	}
+	sortArches(ret)
+	return ret
+}
+
+// Sort a list of Architectures by name, in place.
+func sortArches(arches []dependency.Arch) {
+	sort.Slice(arches, func(i, j int) bool {
+		return arches[i].String() < arches[j].String()
+	})
+}
+
 // Add a given Package to a Package List. Under the hood, this will
 // get or create a IndexWriter, and invoke the .Add method on the
 // Package Writer.
+//
+// Adding a Package with the same name, version and Architecture as one that
+// has already been added to this Component is an error.
 func (c *Component) AddPackage(pkg Package) error {
+	if c.alias != "" {
+		return fmt.Errorf("Component is an alias of '%s'", c.alias)
+	}
+	key := packageKey(pkg)
+	if c.packages[key] {
+		return fmt.Errorf("Package %s was already added", key)
+	}
 	writer, err := c.getWriter(pkg.Architecture)
 	if err != nil {
 		return err
 	}
-	return writer.Add(pkg)
+	if c.RecordTranslations && pkg.DescriptionMD5 == "" {
+		pkg.DescriptionMD5 = descriptionMD5(pkg.Description)
+	}
+	if err := writer.Add(pkg); err != nil {
+		return err
+	}
+	c.packages[key] = true
+	return nil
+}
+
+// Remove every version of the Package `name` for the given Architecture
+// from this Component, so that Engross doesn't write it out, whether it was
+// added with AddPackage or read back with OpenSuite.
+//
+// Removing a Package which is not in this Component is an error, as is
+// removing one once the Suite has been engrossed, like adding one.
+func (c *Component) RemovePackage(name string, arch dependency.Arch) error {
+	if c.alias != "" {
+		return fmt.Errorf("Component is an alias of '%s'", c.alias)
+	}
+	removed, err := c.removePackages(arch, func(pkg Package) bool {
+		return pkg.Package == name
+	})
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return fmt.Errorf("Package %s is not in this Component for %s", name, arch)
+	}
+	return nil
+}
+
+// Remove the Package `name` at version `ver` from this Component, for every
+// Architecture it was added for, like RemovePackage.
+func (c *Component) RemovePackageVersion(name string, ver version.Version) error {
+	if c.alias != "" {
+		return fmt.Errorf("Component is an alias of '%s'", c.alias)
+	}
+	removed := 0
+	for arch := range c.packageWriters {
+		n, err := c.removePackages(arch, func(pkg Package) bool {
+			return pkg.Package == name && version.Compare(pkg.Version, ver) == 0
+		})
+		if err != nil {
+			return err
+		}
+		removed += n
+	}
+	if removed == 0 {
+		return fmt.Errorf("Package %s_%s is not in this Component", name, ver)
+	}
+	return nil
+}
+
+// Remove every Package for the given Architecture for which match returns
+// true, along with any paths recorded for it in the Contents, if no other
+// version of it is left. Returns how many Packages were removed.
+func (c *Component) removePackages(arch dependency.Arch, match func(Package) bool) (int, error) {
+	writer, ok := c.packageWriters[arch]
+	if !ok {
+		return 0, nil
+	}
+
+	names := map[string]bool{}
+	removed, err := writer.remove(func(data interface{}) bool {
+		pkg := data.(Package)
+		if !match(pkg) {
+			return false
+		}
+		delete(c.packages, packageKey(pkg))
+		names[pkg.Package] = true
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	contents, ok := c.contents[arch]
+	if !ok || removed == 0 {
+		return removed, nil
+	}
+	for _, data := range writer.entries {
+		delete(names, data.(Package).Package)
+	}
+	for filePath, packages := range contents {
+		kept := []string{}
+		for _, name := range packages {
+			if !names[path.Base(name)] {
+				kept = append(kept, name)
+			}
+		}
+		if len(kept) == 0 {
+			delete(contents, filePath)
+		} else {
+			contents[filePath] = kept
+		}
+	}
+	return removed, nil
+}
+
+// Get the key that identifies a Source within a Component; no two Sources in
+// a Component may have the same name and version.
+func sourceKey(source Source) string {
+	return fmt.Sprintf("%s_%s", source.Package, source.Version)
+}
+
+// Add a given Source to the Sources index of this Component, which is
+// written out (and listed in the Release) by Engross once any Source has
+// been added. See SourceFromDsc to create the Source, once the files of the
+// source package are in the pool of this Component (see Component.Pool and
+// Pool.IncludeSources).
+//
+// Adding a Source with the same name and version as one that has already
+// been added to this Component is an error.
+func (c *Component) AddSource(source Source) error {
+	if c.alias != "" {
+		return fmt.Errorf("Component is an alias of '%s'", c.alias)
+	}
+	key := sourceKey(source)
+	if c.sources[key] {
+		return fmt.Errorf("Source %s was already added", key)
+	}
+	if c.sourceWriter == nil {
+		writer, err := newSourceWriter(c.suite)
+		if err != nil {
+			return err
+		}
+		c.sourceWriter = writer
+	}
+	if err := c.sourceWriter.Add(source); err != nil {
+		return err
+	}
+	c.sources[key] = true
+	return nil
+}
+
+// Add a given Package to a Package List, like AddPackage, where debFile is
+// the .deb that the Package was created from.
+//
+// If RecordContents is set, the list of files in the .deb is read from its
+// data tarball and recorded, to be written out into the Contents index of
+// this Component. The .deb is opened anew from debFile.Path to do so, so the
+// Data of debFile is left as it was.
+func (c *Component) AddDeb(pkg Package, debFile *deb.Deb) error {
+	if err := c.AddPackage(pkg); err != nil {
+		return err
+	}
+	if !c.RecordContents {
+		return nil
+	}
+
+	name := pkg.Package
+	if pkg.Section != "" {
+		name = path.Join(pkg.Section, pkg.Package)
+	}
+
+	contents, ok := c.contents[pkg.Architecture]
+	if !ok {
+		contents = map[string][]string{}
+		c.contents[pkg.Architecture] = contents
+	}
+
+	reopened, closer, err := deb.LoadFile(debFile.Path)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	for {
+		hdr, err := reopened.Data.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		filePath := strings.TrimPrefix(path.Clean(hdr.Name), "./")
+		contents[filePath] = append(contents[filePath], name)
+	}
+}
+
+// Get the IndexWriter for the Contents index of the given Architecture,
+// which is written out by writeContents, and compressed like any other index.
+func (c *Component) contentsWriter(arch dependency.Arch) *IndexWriter {
+	writer, ok := c.contentsWriters[arch]
+	if !ok {
+		writer = &IndexWriter{
+			suite: c.suite,
+			write: func(out io.Writer) error {
+				return c.writeContents(arch, out)
+			},
+		}
+		c.contentsWriters[arch] = writer
+	}
+	return writer
+}
+
+// Write out the Contents index for the given Architecture to out. Each line
+// has a path, followed by the comma separated list of packages that contain
+// it, sorted by path.
+func (c *Component) writeContents(arch dependency.Arch, out io.Writer) error {
+
+	contents := c.contents[arch]
+	paths := []string{}
+	for filePath := range contents {
+		paths = append(paths, filePath)
+	}
+	sort.Strings(paths)
+
+	writer := bufio.NewWriter(out)
+	for _, filePath := range paths {
+		names := contents[filePath]
+		sort.Strings(names)
+		if _, err := fmt.Fprintf(writer, "%s\t%s\n", filePath, strings.Join(names, ",")); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
 }
 
 // }}}
@@ -422,24 +1092,50 @@ func (c *Component) AddPackage(pkg Package) error {
 // binary .deb files, for a particular Architecture, in a particular Component
 // in a particular Suite, in a particular Archive.
 //
-// This is not an encapsulation to store the entire Index in memory, rather,
-// it's a wrapper to help write Package entries into the Index.
+// The entries added are kept in memory until the Index is committed by
+// Engross, so that they can still be removed until then. Nothing is written
+// (or hashed) until then either, so the hashes and compressions set on the
+// Suite when it's engrossed are the ones used.
 type IndexWriter struct {
-	archive *Archive
+	suite *Suite
 
-	handle  *blobstore.Writer
-	closer  func() error
-	encoder *control.Encoder
+	// Entries added so far, which are encoded into the Index on commit.
+	entries []interface{}
+
+	// If set, this writes out the Index on commit, rather than the entries
+	// being encoded into it, such as for the Contents index.
+	write func(io.Writer) error
 
 	hashers []*hashio.Hasher
+
+	object *blobstore.Object
+
+	// Compressed variants of the index, written alongside it.
+	compressed []*compressedIndex
+}
+
+// A compressed variant of an index being written by an IndexWriter, such as
+// Packages.gz.
+type compressedIndex struct {
+	extension  string
+	handle     *blobstore.Writer
+	compressor io.WriteCloser
+	hashers    []*hashio.Hasher
+	object     *blobstore.Object
 }
 
 func getHashers(suite *Suite) (io.Writer, []*hashio.Hasher, error) {
+	return newHashers(suite.features.Hashes)
+}
+
+// Create a Hasher for each of the given hash algorithms, returning them, as
+// well as an io.Writer which writes to all of them.
+func newHashers(algos []string) (io.Writer, []*hashio.Hasher, error) {
 	ret := []*hashio.Hasher{}
 	writers := []io.Writer{}
 
-	for _, algo := range suite.features.Hashes {
-		hasher, err := hashio.NewHasher(algo)
+	for _, algo := range algos {
+		hasher, err := hashio.NewHasher(normalizeHashName(algo))
 		if err != nil {
 			return nil, nil, err
 		}
@@ -454,6 +1150,17 @@ func getHashers(suite *Suite) (io.Writer, []*hashio.Hasher, error) {
 // the appropriate Hashing, and targeting a new file blob in the
 // underlying blobstore.
 func newIndexWriter(suite *Suite) (*IndexWriter, error) {
+	return &IndexWriter{suite: suite}, nil
+}
+
+// Create a compressedIndex for the given compression (see indexCompressors),
+// targeting a new file blob in the underlying blobstore.
+func newCompressedIndex(suite *Suite, compression string) (*compressedIndex, error) {
+	newCompressor, ok := indexCompressors[compression]
+	if !ok {
+		return nil, fmt.Errorf("Unknown compression: '%s'", compression)
+	}
+
 	handle, err := suite.archive.Store.Create()
 	if err != nil {
 		return nil, err
@@ -461,27 +1168,194 @@ func newIndexWriter(suite *Suite) (*IndexWriter, error) {
 
 	writer, hashers, err := getHashers(suite)
 	if err != nil {
+		handle.Close()
 		return nil, err
 	}
 
-	encoder, err := control.NewEncoder(io.MultiWriter(writer, handle))
+	compressor, err := newCompressor(io.MultiWriter(writer, handle))
 	if err != nil {
 		handle.Close()
 		return nil, err
 	}
 
-	return &IndexWriter{
-		archive: suite.archive,
-		closer:  handle.Close,
-		encoder: encoder,
-		handle:  handle,
-		hashers: hashers,
+	return &compressedIndex{
+		extension:  "." + compression,
+		handle:     handle,
+		compressor: compressor,
+		hashers:    hashers,
 	}, nil
 }
 
-// Write a Package entry into the Packages index.
-func (p IndexWriter) Add(data interface{}) error {
-	return p.encoder.Encode(data)
+// Add a Package entry to the Packages index.
+func (p *IndexWriter) Add(data interface{}) error {
+	if p.object != nil {
+		return fmt.Errorf("Index has already been committed")
+	}
+	p.entries = append(p.entries, data)
+	return nil
+}
+
+// Remove every entry for which match returns true from the index, returning
+// how many were removed. Like Add, this is an error once the index has been
+// committed.
+func (p *IndexWriter) remove(match func(data interface{}) bool) (int, error) {
+	if p.object != nil {
+		return 0, fmt.Errorf("Index has already been committed")
+	}
+	kept := p.entries[:0]
+	for _, data := range p.entries {
+		if !match(data) {
+			kept = append(kept, data)
+		}
+	}
+	removed := len(p.entries) - len(kept)
+	p.entries = kept
+	return removed, nil
+}
+
+// Commit the index into the blobstore, and return a handle to the Object.
+// Subsequent calls will return the same Object without committing again.
+func (p *IndexWriter) commit() (*blobstore.Object, error) {
+	if p.object != nil {
+		return p.object, nil
+	}
+
+	store := p.suite.archive.Store
+	handle, err := store.Create()
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	writer, hashers, err := getHashers(p.suite)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := []io.Writer{writer, handle}
+	compressed := []*compressedIndex{}
+	for _, compression := range p.suite.features.Compressions {
+		index, err := newCompressedIndex(p.suite, compression)
+		if err != nil {
+			return nil, err
+		}
+		defer index.handle.Close()
+		targets = append(targets, index.compressor)
+		compressed = append(compressed, index)
+	}
+	write := p.write
+	if write == nil {
+		write = p.encode
+	}
+	if err := write(io.MultiWriter(targets...)); err != nil {
+		return nil, err
+	}
+	for _, index := range compressed {
+		if err := index.compressor.Close(); err != nil {
+			return nil, err
+		}
+		obj, err := store.Commit(*index.handle)
+		if err != nil {
+			return nil, err
+		}
+		index.object = obj
+	}
+	obj, err := store.Commit(*handle)
+	if err != nil {
+		return nil, err
+	}
+	p.hashers = hashers
+	p.compressed = compressed
+	p.object = obj
+	return obj, nil
+}
+
+// Encode the entries of the index to out.
+func (p *IndexWriter) encode(out io.Writer) error {
+	encoder, err := control.NewEncoder(out)
+	if err != nil {
+		return err
+	}
+	for _, data := range p.entries {
+		if err := encoder.Encode(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit the index, and add it (and each of its compressed variants) to the
+// Release, and to files, at suitePath (such as "main/binary-amd64/Packages",
+// plus the extension of the compression) in the Suite.
+func (p *IndexWriter) engross(suite, suitePath string, release *Release, files ArchiveState) error {
+	obj, err := p.commit()
+	if err != nil {
+		return err
+	}
+
+	if err := addSuiteFile(suite, suitePath, *obj, p.hashers, release, files); err != nil {
+		return err
+	}
+
+	for _, index := range p.compressed {
+		compressedPath := suitePath + index.extension
+		if err := addSuiteFile(suite, compressedPath, *index.object, index.hashers, release, files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add the file obj, hashed by hashers, to the Release, and to files at
+// suitePath (such as "main/binary-amd64/Packages.xz") in the Suite. If the
+// Release has AcquireByHash set, obj is also added at the by-hash path of
+// each of its hashes (such as "main/binary-amd64/by-hash/SHA256/<hash>").
+func addSuiteFile(
+	suite, suitePath string,
+	obj blobstore.Object,
+	hashers []*hashio.Hasher,
+	release *Release,
+	files ArchiveState,
+) error {
+	for _, hasher := range hashers {
+		fileHash := control.FileHashFromHasher(suitePath, *hasher)
+		if err := release.AddHash(fileHash); err != nil {
+			return err
+		}
+		if release.AcquireByHash {
+			files[suiteFilePath(suite, fileHash.ByHashPath(suitePath))] = obj
+		}
+	}
+	files[suiteFilePath(suite, suitePath)] = obj
+	return nil
+}
+
+// }}}
+
+// SourceWriter {{{
+
+// This writer represents a Sources list - which is to say, a list of source
+// packages, in a particular Component in a particular Suite, in a particular
+// Archive. It works just like the IndexWriter for Packages, but only takes
+// Source entries.
+type SourceWriter struct {
+	*IndexWriter
+}
+
+// given a Suite, create a new Source Writer, configured with the
+// appropriate Hashing, and targeting a new file blob in the underlying
+// blobstore.
+func newSourceWriter(suite *Suite) (*SourceWriter, error) {
+	writer, err := newIndexWriter(suite)
+	if err != nil {
+		return nil, err
+	}
+	return &SourceWriter{IndexWriter: writer}, nil
+}
+
+// Write a Source entry into the Sources index.
+func (s *SourceWriter) Add(source Source) error {
+	return s.IndexWriter.Add(source)
 }
 
 // }}}
@@ -0,0 +1,804 @@
+package archive
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+
+	"pault.ag/go/blobstore"
+	"pault.ag/go/debian/control"
+	"pault.ag/go/debian/dependency"
+	"pault.ag/go/debian/version"
+)
+
+// Test Helpers {{{
+
+var (
+	testKeyOnce sync.Once
+	testKey     *openpgp.Entity
+	testKeyErr  error
+)
+
+// Get the OpenPGP key test Archives are signed with. Generating a key is
+// slow, so it's only done once, and shared by every test.
+func newTestKey(t testing.TB) *openpgp.Entity {
+	t.Helper()
+	testKeyOnce.Do(func() {
+		testKey, testKeyErr = openpgp.NewEntity("Test Archive", "", "archive@example.com", nil)
+	})
+	if testKeyErr != nil {
+		t.Fatal(testKeyErr)
+	}
+	return testKey
+}
+
+// Create a new, empty, Archive in a temporary directory, signed with the
+// key from newTestKey.
+func newTestArchive(t testing.TB) *Archive {
+	t.Helper()
+	archive, err := New(t.TempDir(), newTestKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+// Create a Package entry for a .deb which doesn't exist, with every field
+// the Packages index requires set.
+func newTestPackage(t testing.TB, name, ver, arch string) Package {
+	t.Helper()
+	parsedVersion, err := version.Parse(ver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedArch, err := dependency.ParseArch(arch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Package{
+		Package:      name,
+		Version:      parsedVersion,
+		Architecture: *parsedArch,
+		Maintainer:   "Test Maintainer <maintainer@example.com>",
+		Description:  fmt.Sprintf("Test package %s", name),
+		Filename:     fmt.Sprintf("pool/main/%s/%s/%s_%s_%s.deb", name[:1], name, name, ver, arch),
+		Size:         1024,
+		SHA256:       strings.Repeat("ab", 32),
+	}
+}
+
+// Create a Source entry for a source package which isn't in the pool, with
+// every field the Sources index requires set.
+func newTestSource(t testing.TB, name, ver string) Source {
+	t.Helper()
+	parsedVersion, err := version.Parse(ver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Source{
+		Package:    name,
+		Directory:  fmt.Sprintf("pool/main/%s/%s", name[:1], name),
+		Format:     "3.0 (quilt)",
+		Binaries:   []string{name},
+		Version:    parsedVersion,
+		Maintainer: "Test Maintainer <maintainer@example.com>",
+		ChecksumsSha256: []control.SHA256FileHash{{control.FileHash{
+			Algorithm: "sha256",
+			Hash:      strings.Repeat("cd", 32),
+			Size:      2048,
+			Filename:  fmt.Sprintf("%s_%s.dsc", name, ver),
+		}}},
+	}
+}
+
+// Read the content of an Object out of the Store of the Archive.
+func readObject(t testing.TB, a *Archive, obj blobstore.Object) []byte {
+	t.Helper()
+	fd, err := a.Store.Open(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	data, err := ioutil.ReadAll(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Engross the Suite, failing the test on any error.
+func engrossTestSuite(t testing.TB, a *Archive, suite *Suite) ArchiveState {
+	t.Helper()
+	files, err := a.Engross(*suite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// Get the Release of the Suite `name` from the files returned by Engross,
+// without checking its signature.
+func engrossedRelease(t testing.TB, a *Archive, files ArchiveState, name string) *Release {
+	t.Helper()
+	obj, ok := files[suiteFilePath(name, "Release")]
+	if !ok {
+		t.Fatalf("No Release was written for %s", name)
+	}
+	release, err := decodeRelease(bytes.NewReader(readObject(t, a, obj)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return release
+}
+
+// }}}
+
+// Engross {{{
+
+// Build a Suite with a package for every one of the given Components and
+// Architectures, adding them in the order given.
+func newReproducibleSuite(t testing.TB, a *Archive, components, arches []string) *Suite {
+	t.Helper()
+	suite, err := a.Suite("unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range components {
+		component, err := suite.Component(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, arch := range arches {
+			if err := component.AddPackage(newTestPackage(t, "hello-"+name, "1.0-1", arch)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return suite
+}
+
+func TestEngrossReproducible(t *testing.T) {
+	a := newTestArchive(t)
+	when := time.Date(2024, time.January, 2, 3, 4, 5, 0, time.UTC)
+
+	first := newReproducibleSuite(t, a,
+		[]string{"main", "contrib", "non-free"},
+		[]string{"amd64", "arm64", "i386"},
+	)
+	// The Clock is set after the Suite is created, and must still be used
+	// for both the Date and the signatures.
+	a.Clock = func() time.Time { return when }
+	second := newReproducibleSuite(t, a,
+		[]string{"non-free", "main", "contrib"},
+		[]string{"i386", "amd64", "arm64"},
+	)
+
+	firstFiles := engrossTestSuite(t, a, first)
+	secondFiles := engrossTestSuite(t, a, second)
+
+	if len(firstFiles) != len(secondFiles) {
+		t.Fatalf("Engross wrote %d files, then %d", len(firstFiles), len(secondFiles))
+	}
+	for filePath, obj := range firstFiles {
+		other, ok := secondFiles[filePath]
+		if !ok {
+			t.Fatalf("%s was only written the first time", filePath)
+		}
+		if !bytes.Equal(readObject(t, a, obj), readObject(t, a, other)) {
+			t.Errorf("%s is not the same when engrossed twice", filePath)
+		}
+	}
+
+	release := readObject(t, a, firstFiles["dists/unstable/Release"])
+	if !bytes.Contains(release, []byte("Date: Tue, 02 Jan 2024 03:04:05 +0000\n")) {
+		t.Errorf("Release is not dated by the Clock:\n%s", release)
+	}
+
+	block, err := armor.Decode(bytes.NewReader(readObject(t, a, firstFiles["dists/unstable/Release.gpg"])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := packet.Read(block.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, ok := p.(*packet.Signature)
+	if !ok {
+		t.Fatalf("Release.gpg holds a %T, not a signature", p)
+	}
+	if !sig.CreationTime.Equal(when) {
+		t.Errorf("Signature was made at %s, not %s", sig.CreationTime, when)
+	}
+}
+
+func TestEngrossOnlyConfiguredHashes(t *testing.T) {
+	a := newTestArchive(t)
+	suite, err := a.Suite("unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	component, err := suite.Component("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := component.AddPackage(newTestPackage(t, "hello", "1.0-1", "amd64")); err != nil {
+		t.Fatal(err)
+	}
+	// The hashes are set after the Component is created, and must still
+	// be the only ones computed.
+	if err := suite.SetHashes("sha256"); err != nil {
+		t.Fatal(err)
+	}
+
+	files := engrossTestSuite(t, a, suite)
+	release := engrossedRelease(t, a, files, "unstable")
+	if len(release.SHA256) == 0 {
+		t.Fatalf("Release has no SHA256 hashes")
+	}
+	if len(release.SHA1) != 0 || len(release.MD5Sum) != 0 || len(release.SHA512) != 0 {
+		t.Errorf("Release has hashes other than SHA256")
+	}
+
+	raw := readObject(t, a, files[suiteFilePath("unstable", "Release")])
+	for _, block := range []string{"\nSHA1:", "\nMD5Sum:", "\nSHA512:"} {
+		if bytes.Contains(raw, []byte(block)) {
+			t.Errorf("Release has a %s block:\n%s", block[1:], raw)
+		}
+	}
+}
+
+func TestEngrossOnlyConfiguredCompressions(t *testing.T) {
+	a := newTestArchive(t)
+	suite, err := a.Suite("unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	component, err := suite.Component("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := component.AddPackage(newTestPackage(t, "hello", "1.0-1", "amd64")); err != nil {
+		t.Fatal(err)
+	}
+	// The compressions are set after the Component is created, and must
+	// still be the only ones written.
+	if err := suite.SetCompressions("gz"); err != nil {
+		t.Fatal(err)
+	}
+
+	files := engrossTestSuite(t, a, suite)
+	packagesPath := suiteFilePath("unstable", "main/binary-amd64/Packages")
+	for _, filePath := range []string{packagesPath, packagesPath + ".gz"} {
+		if _, ok := files[filePath]; !ok {
+			t.Errorf("%s was not written", filePath)
+		}
+	}
+	if _, ok := files[packagesPath+".xz"]; ok {
+		t.Errorf("%s.xz was written", packagesPath)
+	}
+
+	release := engrossedRelease(t, a, files, "unstable")
+	for _, hash := range release.SHA256 {
+		if strings.HasSuffix(hash.Filename, ".xz") {
+			t.Errorf("Release lists %s", hash.Filename)
+		}
+	}
+}
+
+func TestEngrossSource(t *testing.T) {
+	a := newTestArchive(t)
+	suite, err := a.Suite("unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	component, err := suite.Component("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := component.AddSource(newTestSource(t, "hello", "1.0-1")); err != nil {
+		t.Fatal(err)
+	}
+
+	files := engrossTestSuite(t, a, suite)
+	obj, ok := files[suiteFilePath("unstable", "main/source/Sources")]
+	if !ok {
+		t.Fatalf("No Sources index was written")
+	}
+	sources, err := LoadSources(bytes.NewReader(readObject(t, a, obj)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for source, err := range sources.All() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, source.Package)
+	}
+	if len(names) != 1 || names[0] != "hello" {
+		t.Fatalf("Sources index holds %v, not just hello", names)
+	}
+
+	release := engrossedRelease(t, a, files, "unstable")
+	listed := false
+	for _, hash := range release.SHA256 {
+		listed = listed || hash.Filename == "main/source/Sources"
+	}
+	if !listed {
+		t.Errorf("Release does not list main/source/Sources")
+	}
+}
+
+func TestEngrossCompressedSources(t *testing.T) {
+	a := newTestArchive(t)
+	suite, err := a.Suite("unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	suite.SetAcquireByHash(true)
+	component, err := suite.Component("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := component.AddSource(newTestSource(t, "hello", "1.0-1")); err != nil {
+		t.Fatal(err)
+	}
+
+	files := engrossTestSuite(t, a, suite)
+	release := engrossedRelease(t, a, files, "unstable")
+	listed := map[string]control.SHA256FileHash{}
+	for _, hash := range release.SHA256 {
+		listed[hash.Filename] = hash
+	}
+
+	sources := readObject(t, a, files[suiteFilePath("unstable", "main/source/Sources")])
+	for _, name := range []string{"Sources", "Sources.gz", "Sources.xz"} {
+		indexPath := path.Join("main/source", name)
+		obj, ok := files[suiteFilePath("unstable", indexPath)]
+		if !ok {
+			t.Errorf("%s was not written", indexPath)
+			continue
+		}
+		data := readObject(t, a, obj)
+
+		hash, ok := listed[indexPath]
+		if !ok {
+			t.Errorf("Release does not list %s", indexPath)
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if hash.Hash != hex.EncodeToString(sum[:]) || hash.Size != int64(len(data)) {
+			t.Errorf("Release hash of %s doesn't match the file", indexPath)
+		}
+
+		byHash, ok := files[suiteFilePath("unstable", hash.ByHashPath(indexPath))]
+		if !ok {
+			t.Errorf("%s was not written by-hash", indexPath)
+		} else if byHash != obj {
+			t.Errorf("%s by-hash is not the same Object", indexPath)
+		}
+
+		decompressed, err := Decompress(bytes.NewReader(data), name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := ioutil.ReadAll(decompressed)
+		decompressed.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plain, sources) {
+			t.Errorf("%s does not decompress to Sources", indexPath)
+		}
+	}
+}
+
+func TestEngrossContents(t *testing.T) {
+	a := newTestArchive(t)
+	suite, err := a.Suite("unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := suite.SetCompressions("gz"); err != nil {
+		t.Fatal(err)
+	}
+	component, err := suite.Component("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	component.RecordContents = true
+	if err := suite.AliasComponent("universe", "main"); err != nil {
+		t.Fatal(err)
+	}
+
+	debPath := writeTestDeb(t, t.TempDir(), "hello_1.0-1_amd64.deb", testDebControl, testDebFiles)
+	debFile := loadTestDeb(t, debPath)
+	pkg := newTestPackage(t, "hello", "1.0-1", "amd64")
+	pkg.Section = "misc"
+	if err := component.AddDeb(pkg, debFile); err != nil {
+		t.Fatal(err)
+	}
+	checkDebDataUnread(t, debFile)
+
+	files := engrossTestSuite(t, a, suite)
+	for _, name := range []string{"Contents-amd64", "Contents-amd64.gz"} {
+		obj, ok := files[suiteFilePath("unstable", path.Join("main", name))]
+		if !ok {
+			t.Errorf("main/%s was not written", name)
+			continue
+		}
+		alias, ok := files[suiteFilePath("unstable", path.Join("universe", name))]
+		if !ok {
+			t.Errorf("universe/%s was not written", name)
+		} else if alias != obj {
+			t.Errorf("universe/%s was written again, not shared with main", name)
+		}
+	}
+	if _, ok := files[suiteFilePath("unstable", "main/Contents-amd64.xz")]; ok {
+		t.Errorf("main/Contents-amd64.xz was written")
+	}
+
+	contents := readObject(t, a, files[suiteFilePath("unstable", "main/Contents-amd64")])
+	if !bytes.Contains(contents, []byte("usr/hello\tmisc/hello\n")) {
+		t.Errorf("Contents does not list usr/hello:\n%s", contents)
+	}
+}
+
+func TestEngrossAddHashError(t *testing.T) {
+	a := newTestArchive(t)
+	suite, err := a.Suite("unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	component, err := suite.Component("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg := newTestPackage(t, "hello", "1.0-1", "amd64")
+	if err := component.AddPackage(pkg); err != nil {
+		t.Fatal(err)
+	}
+
+	// The Release already has a different SHA256 for the Packages index,
+	// so adding the one written must fail, and that must not be ignored.
+	release := &Release{}
+	if err := release.AddHash(control.FileHash{
+		Algorithm: "sha256",
+		Hash:      strings.Repeat("00", 32),
+		Size:      1,
+		Filename:  "main/binary-amd64/Packages",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	writer := component.packageWriters[pkg.Architecture]
+	files := ArchiveState{}
+	if err := writer.engross(suite.Name, "main/binary-amd64/Packages", release, files); err == nil {
+		t.Fatalf("A conflicting hash of the Packages index was ignored")
+	}
+}
+
+func TestEngrossReleasePaths(t *testing.T) {
+	a := newTestArchive(t)
+	suite, err := a.Suite("unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := suite.SetCompressions(); err != nil {
+		t.Fatal(err)
+	}
+	component, err := suite.Component("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := component.AddPackage(newTestPackage(t, "hello", "1.0-1", "amd64")); err != nil {
+		t.Fatal(err)
+	}
+
+	files := engrossTestSuite(t, a, suite)
+	release := engrossedRelease(t, a, files, "unstable")
+	names := []string{}
+	for _, hash := range release.SHA256 {
+		names = append(names, hash.Filename)
+	}
+	if len(names) != 1 || names[0] != "main/binary-amd64/Packages" {
+		t.Fatalf("Release lists %v, not just main/binary-amd64/Packages", names)
+	}
+	if _, ok := files["dists/unstable/main/binary-amd64/Packages"]; !ok {
+		t.Errorf("Packages was not written to dists/unstable/main/binary-amd64/Packages")
+	}
+}
+
+// Get the names of the Packages in the Packages index at suitePath of the
+// Suite `name`, from the files returned by Engross.
+func engrossedPackageNames(t testing.TB, a *Archive, files ArchiveState, name, suitePath string) []string {
+	t.Helper()
+	obj, ok := files[suiteFilePath(name, suitePath)]
+	if !ok {
+		t.Fatalf("%s was not written", suitePath)
+	}
+	packages, err := LoadPackages(bytes.NewReader(readObject(t, a, obj)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for pkg, err := range packages.All() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, pkg.Package)
+	}
+	return names
+}
+
+func TestEngrossRemovedPackage(t *testing.T) {
+	a := newTestArchive(t)
+	suite, err := a.Suite("unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	component, err := suite.Component("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alpha", "bravo", "charlie"} {
+		if err := component.AddPackage(newTestPackage(t, name, "1.0-1", "amd64")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	amd64, err := dependency.ParseArch("amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := component.RemovePackage("bravo", *amd64); err != nil {
+		t.Fatal(err)
+	}
+	if err := component.RemovePackage("bravo", *amd64); err == nil {
+		t.Errorf("Removing bravo twice did not fail")
+	}
+
+	files := engrossTestSuite(t, a, suite)
+	names := engrossedPackageNames(t, a, files, "unstable", "main/binary-amd64/Packages")
+	if strings.Join(names, " ") != "alpha charlie" {
+		t.Errorf("Packages index holds %v, not alpha and charlie", names)
+	}
+
+	// Once engrossed, the index can't change any more, so removing a
+	// Package must fail rather than be dropped by the next Engross.
+	if err := component.RemovePackage("alpha", *amd64); err == nil {
+		t.Errorf("Removing alpha after Engross did not fail")
+	}
+	ver, err := version.Parse("1.0-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := component.RemovePackageVersion("charlie", ver); err == nil {
+		t.Errorf("Removing charlie 1.0-1 after Engross did not fail")
+	}
+	files = engrossTestSuite(t, a, suite)
+	names = engrossedPackageNames(t, a, files, "unstable", "main/binary-amd64/Packages")
+	if strings.Join(names, " ") != "alpha charlie" {
+		t.Errorf("Packages index holds %v after engrossing again, not alpha and charlie", names)
+	}
+}
+
+// }}}
+
+// Link {{{
+
+func TestLinkOrder(t *testing.T) {
+	blobs := ArchiveState{}
+	for _, filePath := range []string{
+		"dists/unstable/InRelease",
+		"dists/unstable/Release.gpg",
+		"dists/unstable/Release",
+		"dists/unstable/main/binary-amd64/Packages",
+		"dists/unstable/main/binary-amd64/Packages.xz",
+		"dists/unstable/main/source/Sources",
+		"pool/main/h/hello/hello_1.0-1_amd64.deb",
+	} {
+		blobs[filePath] = blobstore.Object{}
+	}
+
+	order := linkOrder(blobs)
+	want := []string{
+		"dists/unstable/main/binary-amd64/Packages",
+		"dists/unstable/main/binary-amd64/Packages.xz",
+		"dists/unstable/main/source/Sources",
+		"pool/main/h/hello/hello_1.0-1_amd64.deb",
+		"dists/unstable/Release",
+		"dists/unstable/Release.gpg",
+		"dists/unstable/InRelease",
+	}
+	if strings.Join(order, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Files are linked in the order:\n%s", strings.Join(order, "\n"))
+	}
+}
+
+// Commit data into the Store of the Archive, without linking it anywhere.
+func commitTestObject(t testing.TB, a *Archive, data string) blobstore.Object {
+	t.Helper()
+	writer, err := a.Store.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	if _, err := writer.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := a.Store.Commit(*writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *obj
+}
+
+func TestDecruftExcept(t *testing.T) {
+	a := newTestArchive(t)
+	linked := commitTestObject(t, a, "linked")
+	kept := commitTestObject(t, a, "kept")
+	cruft := commitTestObject(t, a, "cruft")
+	if err := a.Store.Link(linked, "dists/unstable/Release"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.DecruftExcept([]blobstore.Object{kept}); err != nil {
+		t.Fatal(err)
+	}
+	for name, obj := range map[string]blobstore.Object{"linked": linked, "kept": kept} {
+		fd, err := a.Store.Open(obj)
+		if err != nil {
+			t.Errorf("The %s object was collected: %s", name, err)
+			continue
+		}
+		fd.Close()
+	}
+	if fd, err := a.Store.Open(cruft); err == nil {
+		fd.Close()
+		t.Errorf("The object which was neither linked nor kept was not collected")
+	}
+}
+
+// }}}
+
+// OpenSuite {{{
+
+func TestOpenSuiteFeatures(t *testing.T) {
+	a := newTestArchive(t)
+	suite := newReproducibleSuite(t, a, []string{"main"}, []string{"amd64"})
+	suite.SetAcquireByHash(true)
+	if err := suite.SetHashes("sha256", "sha512"); err != nil {
+		t.Fatal(err)
+	}
+	if err := suite.SetSignatureFiles(true, false); err != nil {
+		t.Fatal(err)
+	}
+	blobs, err := a.Engross(*suite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Link(blobs); err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := a.OpenSuite("unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opened.features.AcquireByHash {
+		t.Errorf("Acquire-By-Hash was not read back")
+	}
+	if hashes := strings.Join(opened.features.Hashes, " "); hashes != "sha256 sha512" {
+		t.Errorf("The hashes read back are %s", hashes)
+	}
+	if !opened.features.InRelease || opened.features.DetachedRelease {
+		t.Errorf("The signature files read back are InRelease=%t Release.gpg=%t",
+			opened.features.InRelease, opened.features.DetachedRelease)
+	}
+}
+
+// }}}
+
+// Signing {{{
+
+// Benchmark writing out the Release, Release.gpg and InRelease files for a
+// Release with 5000 hash entries; Once encodes the Release once for all
+// three, the way Engross does, and PerFile encodes it again for InRelease,
+// the way it used to.
+func BenchmarkSignRelease(b *testing.B) {
+	a := newTestArchive(b)
+	release := newLargeTestRelease(b, 5000)
+	for _, bench := range []struct {
+		name    string
+		perFile bool
+	}{
+		{"Once", false},
+		{"PerFile", true},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				encoded, err := encodeBytes(release)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, _, err := a.signedObjects(encoded); err != nil {
+					b.Fatal(err)
+				}
+				if bench.perFile {
+					if encoded, err = encodeBytes(release); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if _, err := a.clearsignedObject(encoded); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Signer which counts the signatures made by the Signer it wraps.
+type countingSigner struct {
+	Signer
+	signatures *int
+}
+
+func (c countingSigner) SignDetached(data []byte, sigType packet.SignatureType, h crypto.Hash) ([]byte, error) {
+	*c.signatures++
+	return c.Signer.SignDetached(data, sigType, h)
+}
+
+// Benchmark Engross of a Suite with 3 Components of 100 Architectures each,
+// writing both InRelease and Release.gpg, or InRelease alone, reporting the
+// number of signatures made by each Engross.
+func BenchmarkEngrossSignatureFiles(b *testing.B) {
+	arches := []string{}
+	for i := 0; i < 100; i++ {
+		arches = append(arches, fmt.Sprintf("arch%d", i))
+	}
+	for _, bench := range []struct {
+		name      string
+		inRelease bool
+		detached  bool
+	}{
+		{"InRelease+Release.gpg", true, true},
+		{"InRelease", true, false},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			signatures := 0
+			a, err := NewFromSigners(b.TempDir(), []Signer{countingSigner{
+				Signer:     entitySigner{entity: newTestKey(b)},
+				signatures: &signatures,
+			}})
+			if err != nil {
+				b.Fatal(err)
+			}
+			suite := newReproducibleSuite(b, a, []string{"main", "contrib", "non-free"}, arches)
+			if err := suite.SetSignatureFiles(bench.inRelease, bench.detached); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := a.Engross(*suite); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(signatures)/float64(b.N), "signatures/op")
+		})
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,155 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// PruneByHash {{{
+
+// Remove old by-hash files of the Suite `name` (see Suite.SetAcquireByHash),
+// keeping those of the current Release, and those of the `keep`-1 versions
+// of each index before it, so they can be collected by GC.
+//
+// By-hash files must outlive the Release that lists them for a while. A
+// client fetches the InRelease first, and only then the indices it lists, by
+// hash; if the Suite is published again in between, the client asks for
+// indices that the new Release no longer lists. Keeping `keep` versions lets
+// a client ride out `keep`-1 publishes during a single update, which is
+// what Acquire-By-Hash is for. Removing them as soon as they're no longer
+// listed (or never removing them at all) defeats that, or grows the Archive
+// without bound.
+//
+// The files of the current Release, as listed in its hash blocks, are always
+// kept. Older files are told apart by when they were linked: in each by-hash
+// directory, as many of the most recent older files are kept as there are
+// current files in it, for each older version kept. The Release is read as
+// it is on disk, without checking its signature, since it's only used to
+// decide what not to remove.
+func (a Archive) PruneByHash(name string, keep int) error {
+	if keep < 1 {
+		return fmt.Errorf("At least one version of each index must be kept")
+	}
+
+	release, err := a.currentRelease(name)
+	if err != nil {
+		return err
+	}
+	current := map[string]bool{}
+	for _, algorithm := range []string{"md5", "sha1", "sha256", "sha512"} {
+		for _, fileHash := range release.hashesFor(algorithm) {
+			byHashPath := fileHash.ByHashPath(fileHash.Filename)
+			current[filepath.Join(a.path, suiteFilePath(name, byHashPath))] = true
+		}
+	}
+
+	return filepath.Walk(filepath.Join(a.path, "dists", name), func(dir string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() || filepath.Base(filepath.Dir(dir)) != "by-hash" {
+			return nil
+		}
+		return pruneByHashDir(dir, current, keep)
+	})
+}
+
+// Remove the old files of the by-hash directory dir (such as
+// "main/binary-amd64/by-hash/SHA256"), as described by PruneByHash.
+func pruneByHashDir(dir string, current map[string]bool, keep int) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	older := []os.FileInfo{}
+	currentCount := 0
+	for _, entry := range entries {
+		if current[filepath.Join(dir, entry.Name())] {
+			currentCount++
+			continue
+		}
+		older = append(older, entry)
+	}
+	sort.Slice(older, func(i, j int) bool {
+		return older[i].ModTime().After(older[j].ModTime())
+	})
+
+	kept := currentCount * (keep - 1)
+	for i, entry := range older {
+		if i < kept {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read the current Release of the Suite `name` off disk, from the Release
+// file, or the InRelease file if there's none, without checking any
+// signature.
+func (a Archive) currentRelease(name string) (*Release, error) {
+	suiteDir := filepath.Join(a.path, "dists", name)
+
+	fd, err := os.Open(filepath.Join(suiteDir, "Release"))
+	if err == nil {
+		defer fd.Close()
+		return decodeRelease(fd)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(suiteDir, "InRelease"))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := clearsign.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s/InRelease is not clearsigned", name)
+	}
+	return decodeRelease(bytes.NewReader(block.Plaintext))
+}
+
+// }}}
+
+// GCWithOptions {{{
+
+// Options to control what GCWithOptions removes, beyond what GC does.
+type GCOptions struct {
+	// If more than 0, the by-hash files of every Suite of the Archive are
+	// pruned down to the last ByHashKeep versions of each index before
+	// collecting, see PruneByHash. Otherwise, by-hash files are never
+	// removed, since they're linked.
+	ByHashKeep int
+}
+
+// Like GC, but with GCOptions to control what else is removed.
+func (a Archive) GCWithOptions(options GCOptions) error {
+	if options.ByHashKeep > 0 {
+		suites, err := ioutil.ReadDir(filepath.Join(a.path, "dists"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, suite := range suites {
+			if !suite.IsDir() {
+				continue
+			}
+			if err := a.PruneByHash(suite.Name(), options.ByHashKeep); err != nil {
+				return err
+			}
+		}
+	}
+	return a.GC()
+}
+
+// }}}
+
+// vim: foldmethod=marker
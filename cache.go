@@ -0,0 +1,79 @@
+package archive
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"pault.ag/go/debian/control"
+)
+
+// Cache {{{
+
+// Cache keeps files downloaded by a Downloader, keyed by the hash of their
+// content, so they don't need to be downloaded again.
+type Cache interface {
+	// Get the data stored under key. If there is no such data, an error for
+	// which os.IsNotExist is true must be returned.
+	Get(key string) (io.ReadCloser, error)
+
+	// Store the data read from the io.Reader under key.
+	Put(key string, data io.Reader) error
+
+	// Delete the data stored under key, if any.
+	Delete(key string) error
+}
+
+// Get the key a file with the given FileHash is stored under in a Cache.
+func cacheKey(fh control.FileHash) string {
+	return fh.Algorithm + "-" + fh.Hash
+}
+
+// DirCache is a Cache which keeps each file in the directory it names, in a
+// file named after its key.
+type DirCache string
+
+// Get the data stored under key.
+func (d DirCache) Get(key string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(string(d), key))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Store the data read from the io.Reader under key. The data is written
+// into a temporary file first, so a partial file is never stored.
+func (d DirCache) Put(key string, data io.Reader) error {
+	if err := os.MkdirAll(string(d), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(string(d), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := io.Copy(f, data); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(string(d), key))
+}
+
+// Delete the data stored under key, if any.
+func (d DirCache) Delete(key string) error {
+	err := os.Remove(filepath.Join(string(d), key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
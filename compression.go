@@ -0,0 +1,128 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"pault.ag/go/debian/deb"
+)
+
+// Compression {{{
+
+// Names of the compression algorithms understood by Decompress, keyed by the
+// file extension they're used for.
+var compressionAlgorithms = map[string]string{
+	".gz":   "gzip",
+	".xz":   "xz",
+	".bz2":  "bzip2",
+	".lzma": "lzma",
+	".zst":  "zstd",
+}
+
+// Get the decompressor for files with the given extension, like
+// deb.DecompressorFor, but also knowing about zstd (".zst"), which is used
+// by newer .deb files and indices.
+func decompressorFor(ext string) deb.DecompressorFunc {
+	if ext == ".zst" {
+		return zstdNewReader
+	}
+	return deb.DecompressorFor(ext)
+}
+
+// Decompressor for zstd compressed data.
+func zstdNewReader(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+// Compressors for the compressed variants of the indices written by an
+// Archive, keyed by the name of the compression, which is also the file
+// extension used (without the dot), see Suite.SetCompressions.
+var indexCompressors = map[string]func(io.Writer) (io.WriteCloser, error){
+	"gz": func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	},
+	"xz": func(w io.Writer) (io.WriteCloser, error) {
+		return xz.NewWriter(w)
+	},
+}
+
+// Decompress the data read from reader, picking the compression algorithm
+// based on the extension of fileName. If the extension isn't that of a known
+// compression algorithm, reader is returned as-is.
+//
+// If tee is not nil, everything read from reader (which is to say, the
+// compressed data) is written to it as well, such as to hash it.
+//
+// The returned io.ReadCloser must be closed once done with, to release the
+// decompressor; this doesn't close reader.
+func Decompress(reader io.Reader, fileName string, tee io.Writer) (io.ReadCloser, error) {
+	ret, _, err := DecompressWithInfo(reader, fileName, tee)
+	return ret, err
+}
+
+// Like Decompress, but also return the name of the compression algorithm
+// that was used ("gzip", "xz", "bzip2", "lzma" or "zstd"), or "none" if the
+// data was passed through as-is because the extension of fileName is not
+// known.
+func DecompressWithInfo(reader io.Reader, fileName string, tee io.Writer) (io.ReadCloser, string, error) {
+	if tee != nil {
+		reader = io.TeeReader(reader, tee)
+	}
+
+	ext := filepath.Ext(fileName)
+	algorithm, ok := compressionAlgorithms[ext]
+	if !ok {
+		return ioutil.NopCloser(reader), "none", nil
+	}
+
+	ret, err := decompressorFor(ext)(reader)
+	if err != nil {
+		return nil, algorithm, err
+	}
+	return ret, algorithm, nil
+}
+
+// Magic numbers at the start of data compressed with each of the compression
+// algorithms DecompressDetect knows about, by file extension.
+var compressionMagic = map[string][]byte{
+	".gz":  {0x1f, 0x8b},
+	".xz":  {0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00},
+	".bz2": {0x42, 0x5a, 0x68},
+	".zst": {0x28, 0xb5, 0x2f, 0xfd},
+}
+
+// Like Decompress, but pick the compression algorithm based on the magic
+// number at the start of the data, rather than on a file name, for data
+// which may be served under the wrong (or no) extension. Data which doesn't
+// start with a known magic number is returned as-is. lzma data has no magic
+// number, and is never detected.
+func DecompressDetect(reader io.Reader, tee io.Writer) (io.ReadCloser, error) {
+	if tee != nil {
+		reader = io.TeeReader(reader, tee)
+	}
+
+	buffered := bufio.NewReader(reader)
+	// A short read just means the data is too short to be compressed.
+	header, _ := buffered.Peek(6)
+
+	for ext, magic := range compressionMagic {
+		if bytes.HasPrefix(header, magic) {
+			return decompressorFor(ext)(buffered)
+		}
+	}
+	return ioutil.NopCloser(buffered), nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,86 @@
+package archive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression {{{
+
+func TestDecompressZstd(t *testing.T) {
+	plain := bytes.Repeat([]byte("Package: hello\nVersion: 1.0-1\n\n"), 100)
+
+	compressed := bytes.Buffer{}
+	encoder, err := zstd.NewWriter(&compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encoder.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tee := bytes.Buffer{}
+	rd, algorithm, err := DecompressWithInfo(bytes.NewReader(compressed.Bytes()), "Packages.zst", &tee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algorithm != "zstd" {
+		t.Errorf("Packages.zst was decompressed as %s", algorithm)
+	}
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, plain) {
+		t.Errorf("Packages.zst did not decompress to what was compressed")
+	}
+	if !bytes.Equal(tee.Bytes(), compressed.Bytes()) {
+		t.Errorf("The compressed data was not written to tee")
+	}
+
+	// Without the extension, the magic number is used to tell.
+	rd, err = DecompressDetect(bytes.NewReader(compressed.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	data, err = ioutil.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, plain) {
+		t.Errorf("zstd data was not detected")
+	}
+}
+
+func TestDecompressUncompressed(t *testing.T) {
+	plain := []byte("Package: hello\n")
+	rd, algorithm, err := DecompressWithInfo(bytes.NewReader(plain), "Packages", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	if algorithm != "none" {
+		t.Errorf("Packages was decompressed as %s", algorithm)
+	}
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, plain) {
+		t.Errorf("Packages was not passed through as-is")
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,198 @@
+package archive
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Contents {{{
+
+// A single line of a Contents index: the path of a file, and the packages
+// (as "section/package", or for old archives, "area/section/package") which
+// contain it.
+type ContentsEntry struct {
+	Path     string
+	Packages []string
+}
+
+// Iterator over the lines of a Contents index, such as the one written by
+// Engross for a Component with RecordContents set.
+type Contents struct {
+	scanner *bufio.Scanner
+	started bool
+	pending *ContentsEntry
+
+	// If set, called once by Close, or once Next returns io.EOF, to release
+	// whatever the Contents index is read from.
+	closer func() error
+}
+
+// Release whatever the Contents index is being read from, such as the file
+// opened by LoadContentsFile. This is done automatically once Next returns
+// io.EOF, so it's only needed if the Contents is not read to the end. It's
+// safe to call more than once.
+func (c *Contents) Close() error {
+	if c.closer == nil {
+		return nil
+	}
+	closer := c.closer
+	c.closer = nil
+	return closer()
+}
+
+// }}}
+
+// Next {{{
+
+// Get the next ContentsEntry in the Contents index. This will return an
+// io.EOF at the last entry.
+func (c *Contents) Next() (*ContentsEntry, error) {
+	if !c.started {
+		c.started = true
+		if err := c.skipHeader(); err != nil {
+			return nil, err
+		}
+	}
+	if c.pending != nil {
+		entry := c.pending
+		c.pending = nil
+		return entry, nil
+	}
+
+	for c.scanner.Scan() {
+		line := c.scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		return parseContentsLine(line)
+	}
+	if err := c.scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := c.Close(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// Older Contents indices start with a block of free form text explaining
+// what the file is, ending with a "FILE LOCATION" line, before the entries.
+// If this Contents has such a header, skip it, otherwise keep the first
+// entry around for Next to return.
+func (c *Contents) skipHeader() error {
+	for c.scanner.Scan() {
+		line := c.scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if isContentsHeaderEnd(line) {
+			return nil
+		}
+		if !strings.HasPrefix(line, "This file maps each file") {
+			entry, err := parseContentsLine(line)
+			if err != nil {
+				return err
+			}
+			c.pending = entry
+			return nil
+		}
+		for c.scanner.Scan() {
+			if isContentsHeaderEnd(c.scanner.Text()) {
+				return nil
+			}
+		}
+		break
+	}
+	return c.scanner.Err()
+}
+
+// Check to see if the line is the "FILE LOCATION" line at the end of the
+// header of a Contents index.
+func isContentsHeaderEnd(line string) bool {
+	fields := strings.Fields(line)
+	return len(fields) == 2 && fields[0] == "FILE" && fields[1] == "LOCATION"
+}
+
+// Parse a line of a Contents index. The path may itself contain spaces, so
+// the list of packages is everything after the last run of whitespace.
+func parseContentsLine(line string) (*ContentsEntry, error) {
+	line = strings.TrimRight(line, " \t")
+	i := strings.LastIndexAny(line, " \t")
+	if i < 0 {
+		return nil, fmt.Errorf("Malformed Contents line: '%s'", line)
+	}
+	return &ContentsEntry{
+		Path:     strings.TrimRight(line[:i], " \t"),
+		Packages: strings.Split(line[i+1:], ","),
+	}, nil
+}
+
+// }}}
+
+// Find {{{
+
+// Read the rest of the Contents index, looking for the given path, and
+// return the packages which contain it, or nil if none do. A leading "/" or
+// "./" on the path is ignored, since Contents paths have neither.
+func (c *Contents) Find(filePath string) ([]string, error) {
+	filePath = strings.TrimPrefix(strings.TrimPrefix(filePath, "./"), "/")
+	for {
+		entry, err := c.Next()
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if entry.Path == filePath {
+			return entry.Packages, nil
+		}
+	}
+}
+
+// }}}
+
+// LoadContentsFile {{{
+
+// Given a path, create a Contents iterator. Note that the Contents file is
+// not OpenPGP signed, so one will need to verify the integrety of this file
+// from the InRelease file before trusting any output.
+//
+// The file is closed once the iterator returns io.EOF, or is closed with
+// Contents.Close.
+func LoadContentsFile(path string) (*Contents, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := LoadContents(fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	contents.closer = fd.Close
+	return contents, nil
+}
+
+// }}}
+
+// LoadContents {{{
+
+// Given an io.Reader, create a Contents iterator. Note that the Contents
+// file is not OpenPGP signed, so one will need to verify the integrety of
+// this file from the InRelease file before trusting any output.
+//
+// Both the tab separated format written by Engross, and the whitespace
+// aligned format (with or without the old free form header) written by dak
+// are accepted.
+func LoadContents(in io.Reader) (*Contents, error) {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, 1024*1024)
+	return &Contents{scanner: scanner}, nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -2,13 +2,18 @@ package archive
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -16,6 +21,9 @@ import (
 	"golang.org/x/crypto/openpgp"
 	"pault.ag/go/debian/control"
 	"pault.ag/go/debian/deb"
+	"pault.ag/go/debian/dependency"
+	"pault.ag/go/debian/hashio"
+	"pault.ag/go/debian/version"
 )
 
 type pool struct {
@@ -34,11 +42,25 @@ func (p *pool) lock() {
 	p.ch <- true
 }
 
+// lockContext is like lock, but gives up with ctx.Err() if ctx is done
+// before a worker is free.
+func (p *pool) lockContext(ctx context.Context) error {
+	select {
+	case p.ch <- true:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (p *pool) unlock() {
 	<-p.ch
 }
 
 // Downloader makes files from the Debian archive available.
+//
+// All HTTP requests made by a Downloader go through one shared http.Client,
+// so connections to the mirror are reused across files.
 type Downloader struct {
 	// Parallel limits the maximum number of concurrent archive accesses.
 	Parallel int
@@ -47,89 +69,371 @@ type Downloader struct {
 	// The default value of 0 means retry forever.
 	MaxTransientRetries int
 
+	// RetryBaseDelay and RetryMaxDelay control how long to wait between
+	// retries of transient errors: RetryBaseDelay (by default, 500ms) is
+	// doubled for each retry, up to RetryMaxDelay (by default, 5s), with
+	// jitter. A Retry-After sent along with an HTTP 503 takes precedence.
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+
 	// Mirror is the HTTP URL of a Debian mirror, e.g. "https://deb.debian.org/debian".
 	// Mirror supports TLS and HTTP/2.
 	Mirror string
 
+	// Mirrors, if set, is used instead of Mirror: a list of the HTTP URLs of
+	// equivalent mirrors to fail over between. Each file is fetched from
+	// the mirror that last worked, and if that fails (with a transient
+	// error, or a 404 since a mirror may be partial), from each of the
+	// others in turn.
+	Mirrors []string
+
 	// LocalMirror overrides Mirror with a local file system path.
 	// E.g. /srv/mirrors/debian on DSA-maintained machines.
 	LocalMirror string
 
+	// SuiteMirrors maps a suite to the HTTP URL of the mirror it is served
+	// from, overriding Mirror and LocalMirror for that suite, e.g.
+	// "bookworm-security" to "https://security.debian.org/debian-security".
+	// Pool files of a suite are fetched from the same mirror as the suite.
+	SuiteMirrors map[string]string
+
+	// RewriteURL, if set, is called with the URL of every HTTP request just
+	// before it is made, and the URL it returns is fetched instead. This can
+	// be used to go through a caching proxy or CDN with a different URL
+	// layout. It runs for every request, including retries and by-hash
+	// requests, but never for files read from LocalMirror.
+	RewriteURL func(rawURL string) string
+
+	// Clock returns the current time, and is used for all checks of the
+	// validity or expiry of archive metadata. The default value of nil means
+	// time.Now is used; it can be set to get deterministic results.
+	Clock func() time.Time
+
+	// ExpectOrigin and ExpectLabel, if set, must match the Origin and Label
+	// of every Release loaded, or Release will return an error. This guards
+	// against a mirror serving the Release of another repository under the
+	// expected suite name.
+	ExpectOrigin string
+	ExpectLabel  string
+
+	// RejectExpiredKeys rejects release metadata signed by a key which has
+	// expired. AllowExpiredKeys instead accepts it as long as the key was
+	// still valid when the signature was made, see ReleaseOptions.
+	RejectExpiredKeys bool
+	AllowExpiredKeys  bool
+
+	// PinnedFingerprints, if set, restricts which keys in the Keyring may
+	// sign release metadata, see ReleaseOptions.
+	PinnedFingerprints []string
+
+	// RejectExpired makes Release return a *ReleaseExpiredError for a
+	// Release whose Valid-Until has passed, see Release.IsExpired and
+	// ReleaseOptions.RejectExpired.
+	RejectExpired bool
+
 	// TempDir is passed as dir argument to ioutil.TempFile.
 	// The default value of empty string uses the default directory, see os.TempDir.
 	TempDir string
 
-	once sync.Once
-	pool *pool
+	// DisableTransportCompression sends "Accept-Encoding: identity" and turns
+	// off the HTTP client's transparent decompression. Use this for mirrors
+	// which serve e.g. Packages.gz with an additional "Content-Encoding: gzip",
+	// which would otherwise confuse the filename-based decompression.
+	DisableTransportCompression bool
+
+	// RecordManifest enables recording every file downloaded and verified,
+	// see Manifest.
+	RecordManifest bool
+
+	// HTTPClient, if set, is used for every HTTP request, such as to go
+	// through a proxy, use a custom TLS configuration or timeouts, or talk
+	// to an httptest.Server. The default value of nil means a client of the
+	// Downloader's own is used (never http.DefaultClient), see newClient.
+	// Note that DisableTransportCompression only turns off the transparent
+	// decompression of the default client. The client is copied, so that
+	// Authorization headers are stripped from cross-host redirects (see
+	// checkRedirect) no matter its own CheckRedirect.
+	HTTPClient *http.Client
+
+	// Progress, if set, is called as each file is downloaded, with the
+	// number of bytes downloaded so far, and the total size of the file (from
+	// the Content-Length of the response), or -1 if that's not known. Both
+	// count the raw data as fetched (so, still compressed), not the
+	// decompressed data written to the temporary file. Progress is not
+	// called for files read from the Cache, nor again once a download
+	// fails, and may be called from several goroutines at once if Parallel
+	// is more than 1.
+	Progress func(downloaded, total int64)
+
+	once   sync.Once
+	pool   *pool
+	client *http.Client
+
+	mirrorMu        sync.Mutex
+	preferredMirror int
+
+	manifestMu sync.Mutex
+	manifest   []ManifestEntry
+	// Cache, if set, keeps the files downloaded (other than the release
+	// metadata itself) across runs. Files are keyed by their hash, as
+	// listed in the Release or index they came from, so a file in the Cache
+	// never needs to be revalidated against the mirror. A cached file which
+	// no longer matches its hash is deleted and downloaded again. VerifyAll
+	// and VerifyAllStream never use the Cache, since they check what the
+	// mirror serves.
+	Cache Cache
+
 	// Keyring is used for validating archive GPG signatures. If nil, the
 	// keyring is loaded from DebianArchiveKeyring.
 	Keyring openpgp.EntityList
+
+	// Verifier, if set, checks the signatures of release metadata instead
+	// of the Keyring (which is then not loaded at all), such as for an
+	// archive not signed with OpenPGP. The InRelease, or Release and
+	// Release.gpg, files are still the ones fetched.
+	Verifier ReleaseVerifier
 }
 
 type transientError struct {
 	error
+
+	// retryAfter is how long the server asked us to wait before retrying,
+	// from its Retry-After header, if any.
+	retryAfter time.Duration
+}
+
+type notFoundError struct {
+	error
+}
+
+// IsNotFound returns whether err signals that a file (or package) is not
+// present on the mirror.
+func IsNotFound(err error) bool {
+	return isNotFound(err)
+}
+
+// isNotFound returns whether err signals that a file is not present on the
+// mirror at all.
+func isNotFound(err error) bool {
+	if _, ok := err.(notFoundError); ok {
+		return true
+	}
+	return os.IsNotExist(err)
+}
+
+// now returns the current time, as given by Clock.
+func (g *Downloader) now() time.Time {
+	if g.Clock != nil {
+		return g.Clock()
+	}
+	return time.Now()
+}
+
+// suiteMirror returns the HTTP URL of the mirror serving suite, if it is set
+// in SuiteMirrors, or the empty string if suite is served from the default
+// Mirror (or LocalMirror).
+func (g *Downloader) suiteMirror(suite string) string {
+	return g.SuiteMirrors[suite]
 }
 
-// open returns an io.ReadCloser for reading fn from the archive, and fns last
-// modification time.
-func (g *Downloader) open(fn string) (io.ReadCloser, time.Time, error) {
+// mirrors returns the HTTP URLs of the default mirrors, which is Mirrors, or
+// just Mirror if that's not set.
+func (g *Downloader) mirrors() []string {
+	if len(g.Mirrors) != 0 {
+		return g.Mirrors
+	}
+	return []string{g.Mirror}
+}
+
+// url returns the location of fn in the archive; its URL on mirror if set,
+// the full path to it if LocalMirror is set, or its URL on the preferred
+// default mirror (see mirrors) otherwise.
+func (g *Downloader) url(mirror, fn string) string {
+	if mirror != "" {
+		return strings.TrimSuffix(mirror, "/") + "/" + fn
+	}
 	if g.LocalMirror != "" {
-		f, err := os.Open(filepath.Join(g.LocalMirror, fn))
+		return filepath.Join(g.LocalMirror, fn)
+	}
+	mirrors := g.mirrors()
+	g.mirrorMu.Lock()
+	defer g.mirrorMu.Unlock()
+	return strings.TrimSuffix(mirrors[g.preferredMirror%len(mirrors)], "/") + "/" + fn
+}
+
+// open returns an io.ReadCloser for reading fn from the archive, the URL it
+// is read from (see url), fns last modification time, and its size (or -1 if
+// that's not known up front). The HTTP request is cancelled when ctx is
+// done.
+//
+// If mirror is empty, and there's more than one default mirror, fn is
+// fetched from the preferred one, failing over to each of the others in
+// turn, see Mirrors.
+func (g *Downloader) open(ctx context.Context, mirror, fn string) (io.ReadCloser, string, time.Time, int64, error) {
+	if mirror != "" || g.LocalMirror != "" {
+		return g.openURL(ctx, mirror, fn)
+	}
+
+	mirrors := g.mirrors()
+	g.mirrorMu.Lock()
+	start := g.preferredMirror
+	g.mirrorMu.Unlock()
+
+	var transient, err error
+	for i := range mirrors {
+		n := (start + i) % len(mirrors)
+		var (
+			r       io.ReadCloser
+			u       string
+			modTime time.Time
+			size    int64
+		)
+		r, u, modTime, size, err = g.openURL(ctx, mirrors[n], fn)
+		if err == nil {
+			g.mirrorMu.Lock()
+			g.preferredMirror = n
+			g.mirrorMu.Unlock()
+			return r, u, modTime, size, nil
+		}
+		if _, ok := err.(transientError); ok {
+			transient = err
+		} else if !isNotFound(err) {
+			return nil, "", time.Time{}, 0, err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	// If any mirror failed transiently, it's worth retrying, even if the
+	// others didn't have fn at all.
+	if transient != nil {
+		return nil, "", time.Time{}, 0, transient
+	}
+	return nil, "", time.Time{}, 0, err
+}
+
+// openURL is like open, but fetches fn from exactly one mirror (see url).
+func (g *Downloader) openURL(ctx context.Context, mirror, fn string) (io.ReadCloser, string, time.Time, int64, error) {
+	if mirror == "" && g.LocalMirror != "" {
+		fp := g.url(mirror, fn)
+		f, err := os.Open(fp)
 		if err != nil {
-			return nil, time.Time{}, err
+			return nil, "", time.Time{}, 0, err
 		}
 		fi, err := f.Stat()
 		if err != nil {
-			return nil, time.Time{}, err
+			return nil, "", time.Time{}, 0, err
 		}
-		return f, fi.ModTime(), nil
+		return f, fp, fi.ModTime(), fi.Size(), nil
 	}
-	u := strings.TrimSuffix(g.Mirror, "/") + "/" + fn
-	resp, err := http.Get(u)
+	mirrorURL := g.url(mirror, fn)
+	u := mirrorURL
+	if g.RewriteURL != nil {
+		u = g.RewriteURL(u)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
-		return nil, time.Time{}, transientError{err}
+		return nil, "", time.Time{}, 0, err
+	}
+	if g.DisableTransportCompression {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, "", time.Time{}, 0, transientError{error: err}
 	}
 	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		// Drain the body so the connection can be reused for the next
+		// request, rather than being torn down.
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
 		err := fmt.Errorf("download(%s): unexpected HTTP status code: got %d, want %d", u, got, want)
 		// Not entirely accurate or exhaustive, but HTTP 5xx is generally
 		// transient.
 		if resp.StatusCode >= 500 && resp.StatusCode < 600 {
-			return nil, time.Time{}, transientError{err}
+			te := transientError{error: err}
+			if resp.StatusCode == http.StatusServiceUnavailable {
+				te.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), g.now())
+			}
+			return nil, "", time.Time{}, 0, te
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, "", time.Time{}, 0, notFoundError{err}
 		}
-		return nil, time.Time{}, err
+		return nil, "", time.Time{}, 0, err
 	}
 	modTime, err := http.ParseTime(resp.Header.Get("Last-Modified"))
 	if err != nil {
-		return nil, time.Time{}, err
+		resp.Body.Close()
+		return nil, "", time.Time{}, 0, err
 	}
-	return resp.Body, modTime, nil
+	return resp.Body, mirrorURL, modTime, resp.ContentLength, nil
 }
 
-func (g *Downloader) tempFileWithFilename(verifier io.WriteCloser, decompressor deb.DecompressorFunc, fn string) (*os.File, error) {
-	g.pool.lock()
+// tempFileWithFilename downloads fn from mirror (see url) into a temporary
+// file, passing the downloaded data through verifier and decompressor. If
+// ctx is done before the download completes, it's aborted, and the partial
+// temporary file is removed.
+//
+// If key is not empty, and a Cache is set, the Cache is consulted for key
+// before downloading, and the downloaded data is put in the Cache under key
+// once it has been verified. key must identify the content of fn, see
+// cacheKey.
+func (g *Downloader) tempFileWithFilename(ctx context.Context, verifier io.WriteCloser, decompressor deb.DecompressorFunc, mirror, fn, key string) (*os.File, error) {
+	if err := g.pool.lockContext(ctx); err != nil {
+		return nil, err
+	}
 	defer g.pool.unlock()
 
 	f, err := ioutil.TempFile(g.TempDir, "archive-")
 	if err != nil {
 		return nil, err
 	}
+	done := false
+	defer func() {
+		if !done {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
 
 	var (
 		r       io.ReadCloser
 		modTime time.Time
+		size    int64 = -1
+		raw     *os.File
+		cached  bool
 	)
-	for retry := 0; ; retry++ {
+	if g.Cache != nil && key != "" {
+		cachedReader, err := g.cachedFile(key)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			r, cached = cachedReader, true
+			if m, ok := verifier.(sourceRecorder); ok {
+				m.setCached()
+			}
+		}
+	}
+	for retry := 0; r == nil; retry++ {
 		var err error
-		r, modTime, err = g.open(fn)
+		var u string
+		r, u, modTime, size, err = g.open(ctx, mirror, fn)
 		if err == nil {
+			if m, ok := verifier.(sourceRecorder); ok {
+				m.setURL(u)
+			}
 			break
 		}
-		if te, ok := err.(transientError); ok && retry < g.MaxTransientRetries {
-			log.Printf("transient error %v, retrying (attempt %d of %d)", te, retry, g.MaxTransientRetries)
+		if te, ok := err.(transientError); ok && retry < g.MaxTransientRetries && ctx.Err() == nil {
+			delay := g.retryDelay(retry, te)
+			log.Printf("transient error %v, retrying in %v (attempt %d of %d)", te, delay, retry, g.MaxTransientRetries)
+			if err := sleepContext(ctx, delay); err != nil {
+				return nil, err
+			}
 			continue
 		}
-		os.Remove(f.Name())
-		f.Close()
 		return nil, err
 	}
 	defer r.Close()
@@ -138,10 +442,29 @@ func (g *Downloader) tempFileWithFilename(verifier io.WriteCloser, decompressor
 		return nil, err
 	}
 
-	rd, err := decompressor(io.TeeReader(r, verifier))
+	var tee io.Writer = verifier
+	if g.Cache != nil && key != "" && !cached {
+		// Keep a copy of the data as downloaded, to be put in the Cache
+		// once verified.
+		raw, err = ioutil.TempFile(g.TempDir, "archive-cache-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(raw.Name())
+		defer raw.Close()
+		tee = io.MultiWriter(verifier, raw)
+	}
+
+	var in io.Reader = contextReader{ctx, r}
+	if g.Progress != nil && !cached {
+		in = &progressReader{r: in, total: size, progress: g.Progress}
+	}
+
+	rd, err := decompressor(io.TeeReader(in, tee))
 	if err != nil {
 		return nil, err
 	}
+	defer rd.Close()
 
 	w := bufio.NewWriter(f)
 
@@ -161,13 +484,150 @@ func (g *Downloader) tempFileWithFilename(verifier io.WriteCloser, decompressor
 		return nil, err
 	}
 
-	if err := os.Chtimes(f.Name(), modTime, modTime); err != nil {
-		return nil, err
+	if raw != nil {
+		if _, err := raw.Seek(0, os.SEEK_SET); err != nil {
+			return nil, err
+		}
+		if err := g.Cache.Put(key, raw); err != nil {
+			return nil, err
+		}
 	}
 
+	if !cached {
+		if err := os.Chtimes(f.Name(), modTime, modTime); err != nil {
+			return nil, err
+		}
+	}
+
+	done = true
 	return f, nil
 }
 
+// retryDelay returns how long to wait before retrying a download after the
+// given (zero-based) retry failed with te: the Retry-After the server asked
+// for, if any, or else RetryBaseDelay doubled for each retry, capped at
+// RetryMaxDelay, with jitter.
+func (g *Downloader) retryDelay(retry int, te transientError) time.Duration {
+	if te.retryAfter > 0 {
+		return te.retryAfter
+	}
+
+	base, max := g.RetryBaseDelay, g.RetryMaxDelay
+	if base <= 0 {
+		base = 500 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 5 * time.Second
+	}
+
+	delay := max
+	if retry < 32 && base<<uint(retry) < max && base<<uint(retry) > 0 {
+		delay = base << uint(retry)
+	}
+	// Wait somewhere between half and all of the delay, so that many
+	// downloads failing at once don't all retry at once, too.
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either
+// a number of seconds, or an HTTP date, into how long to wait as of now. If
+// the value is missing or can't be parsed, 0 is returned.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil && when.After(now) {
+		return when.Sub(now)
+	}
+	return 0
+}
+
+// sleepContext waits for d, returning early with ctx.Err() if ctx is done
+// first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// cachedFile returns the data stored in the Cache under key (see cacheKey),
+// once it has been checked against the hash in key. Data which doesn't match
+// (such as a file corrupted on disk) is deleted from the Cache, and an error
+// for which os.IsNotExist is true is returned, so it's downloaded again.
+func (g *Downloader) cachedFile(key string) (io.ReadCloser, error) {
+	i := strings.Index(key, "-")
+	if i < 0 {
+		return nil, fmt.Errorf("Malformed cache key %q", key)
+	}
+	fh := control.FileHash{Algorithm: key[:i], Hash: key[i+1:]}
+	verifier, err := fh.Verifier()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := g.Cache.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(verifier, r)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := verifier.Close(); err != nil {
+		log.Printf("cached %s is corrupt (%v), downloading it again", key, err)
+		if err := g.Cache.Delete(key); err != nil {
+			return nil, err
+		}
+		return nil, os.ErrNotExist
+	}
+	return g.Cache.Get(key)
+}
+
+// progressReader is an io.Reader which calls progress with the number of
+// bytes read so far (and the total, or -1) after every successful read.
+type progressReader struct {
+	r          io.Reader
+	downloaded int64
+	total      int64
+	progress   func(downloaded, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	if n > 0 {
+		p.downloaded += int64(n)
+		p.progress(p.downloaded, p.total)
+	}
+	return n, err
+}
+
+// contextReader is an io.Reader which fails with ctx.Err() once ctx is done,
+// so that copying from it stops when a download is cancelled, even when
+// reading from something (such as a LocalMirror) that ignores ctx.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
 // TempFile calls ioutil.TempFile, then downloads fh from the archive and
 // returns it.
 //
@@ -194,29 +654,79 @@ func (g *Downloader) tempFileWithFilename(verifier io.WriteCloser, decompressor
 //    defer os.Remove(f.Name()) // remove from file system
 //    return exec.Command("tar", "xf", f.Name()).Run()
 func (g *Downloader) TempFile(fh control.FileHash) (*os.File, error) {
+	return g.TempFileContext(context.Background(), fh)
+}
+
+// TempFileContext is like TempFile, but the download is aborted (and the
+// temporary file removed) if ctx is done before it completes.
+func (g *Downloader) TempFileContext(ctx context.Context, fh control.FileHash) (*os.File, error) {
 	if err := g.init(); err != nil {
 		return nil, err
 	}
 
-	verifier, err := fh.Verifier()
+	verifier, err := g.verifier(fh, "", fh.Filename)
 	if err != nil {
 		return nil, err
 	}
-	decompressor := deb.DecompressorFor(filepath.Ext(fh.Filename))
-	return g.tempFileWithFilename(verifier, decompressor, fh.Filename)
+	decompressor := decompressorFor(filepath.Ext(fh.Filename))
+	return g.tempFileWithFilename(ctx, verifier, decompressor, "", fh.Filename, cacheKey(fh))
 }
 
 func (g *Downloader) init() error {
 	var err error
 	g.once.Do(func() {
 		g.pool = newPool(g.Parallel)
-		if g.Keyring == nil {
+		if g.HTTPClient != nil {
+			// Copy the client, so its CheckRedirect can be wrapped
+			// without changing the one passed in.
+			client := *g.HTTPClient
+			client.CheckRedirect = checkRedirect(g.HTTPClient.CheckRedirect)
+			g.client = &client
+		} else {
+			g.client = g.newClient()
+		}
+		if g.Keyring == nil && g.Verifier == nil {
 			err = g.loadArchiveKeyrings()
 		}
 	})
 	return err
 }
 
+// newClient returns the http.Client used for all requests made by g.
+//
+// A single client (and so, a single Transport) is shared by every request
+// made by a Downloader, so connections to the mirror are kept alive and, for
+// mirrors supporting HTTP/2, multiplexed, rather than a new connection being
+// dialed for each index or pool file.
+func (g *Downloader) newClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableCompression = g.DisableTransportCompression
+	return &http.Client{
+		Transport:     transport,
+		CheckRedirect: checkRedirect(nil),
+	}
+}
+
+// checkRedirect returns the CheckRedirect policy of the http.Client used by
+// a Downloader. It never sends an Authorization header (such as credentials
+// for a private mirror) to any host other than the one originally requested,
+// and then defers to next, the policy of the HTTPClient it was given. If next
+// is nil, like the default policy, it stops after 10 redirects.
+func checkRedirect(next func(*http.Request, []*http.Request) error) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if req.URL.Host != via[0].URL.Host {
+			req.Header.Del("Authorization")
+		}
+		if next != nil {
+			return next(req, via)
+		}
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after 10 redirects")
+		}
+		return nil
+	}
+}
+
 // DebianArchiveKeyring is the full path to the GPG keyring containing the
 // public keys used for signing the Debian archive.
 const DebianArchiveKeyring = "/usr/share/keyrings/debian-archive-keyring.gpg"
@@ -247,20 +757,529 @@ type ReleaseDownloader struct {
 	acquireByHash bool
 	g             *Downloader
 	suite         string
+	mirror        string
+	release       *Release
 }
 
 // GetTempFile is like Downloader.GetTempFile, but for fhs of the release.
 func (r *ReleaseDownloader) TempFile(fh control.FileHash) (*os.File, error) {
+	return r.TempFileContext(context.Background(), fh)
+}
+
+// TempFileContext is like TempFile, but the download is aborted (and the
+// temporary file removed) if ctx is done before it completes.
+func (r *ReleaseDownloader) TempFileContext(ctx context.Context, fh control.FileHash) (*os.File, error) {
+	return r.tempFile(ctx, fh, cacheKey(fh))
+}
+
+// tempFile is like TempFileContext, but the Cache is only used if key (see
+// cacheKey) is not empty. VerifyAll and VerifyAllStream pass an empty key,
+// since they check what the mirror serves, not what's in the Cache.
+func (r *ReleaseDownloader) tempFile(ctx context.Context, fh control.FileHash, key string) (*os.File, error) {
+	fn := r.indexPath(fh)
+	verifier, err := r.g.verifier(fh, r.mirror, fn)
+	if err != nil {
+		return nil, err
+	}
+	// Pick the decompressor by the name of the index, never by fn: a by-hash
+	// path has no extension, but its content is just as compressed.
+	decompressor := decompressorFor(filepath.Ext(fh.Filename))
+	return r.g.tempFileWithFilename(ctx, verifier, decompressor, r.mirror, fn, key)
+}
+
+// indexPath returns the path of the index fh of the release, relative to the
+// root of the mirror.
+func (r *ReleaseDownloader) indexPath(fh control.FileHash) string {
 	fn := "dists/" + r.suite + "/" + fh.Filename
 	if r.acquireByHash {
 		fn = fh.ByHashPath(fn)
 	}
+	return fn
+}
+
+// poolTempFile is like tempFile, but for fhs of the pool, which are relative
+// to the root of the mirror and are never decompressed.
+func (r *ReleaseDownloader) poolTempFile(fh control.FileHash, key string) (*os.File, error) {
+	verifier, err := r.g.verifier(fh, r.mirror, fh.Filename)
+	if err != nil {
+		return nil, err
+	}
+	decompressor := decompressorFor("") // pool files are kept as-is
+	return r.g.tempFileWithFilename(context.Background(), verifier, decompressor, r.mirror, fh.Filename, key)
+}
+
+// VerifyAll downloads every index listed in the release and verifies it
+// against its checksum, returning the first failure. Indices which are not
+// present on the mirror are skipped, since a Release must list checksums for
+// uncompressed indices even if only compressed ones are served.
+//
+// If fetchPool is true, each Packages and Sources index is parsed as well,
+// and every pool file referenced by it is downloaded and verified against
+// its SHA256.
+func (r *ReleaseDownloader) VerifyAll(fetchPool bool) error {
+	indices := r.release.Indices()
+	names := make([]string, 0, len(indices))
+	for name := range indices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	walked := map[string]bool{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		f, err := r.tempFile(context.Background(), indices[name][0], "")
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return fmt.Errorf("verify(%s): %v", name, err)
+		}
+
+		base := strings.TrimSuffix(name, filepath.Ext(name))
+		if fetchPool && !walked[base] {
+			walked[base] = true
+			err = r.verifyPoolFiles(path.Base(base), f, seen)
+		}
+		f.Close()
+		os.Remove(f.Name())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileResult is the outcome of verifying a single index, as sent by
+// VerifyAllStream.
+type FileResult struct {
+	// Filename is the name of the index, relative to the directory of the
+	// release (e.g. "main/binary-amd64/Packages.xz").
+	Filename string
+
+	// Algorithm is the hash algorithm the index was verified with, and
+	// Expected the hash the release lists for it.
+	Algorithm string
+	Expected  string
+
+	// Actual and Size are the hash and size of the data downloaded. They are
+	// empty if the download failed before all of it was read.
+	Actual string
+	Size   int64
+
+	// Err is nil if the index was downloaded and matched Expected. If the
+	// index is not present on the mirror, IsNotFound(Err) is true; this is
+	// not a failure, since a Release must list checksums for uncompressed
+	// indices even if only compressed ones are served.
+	Err error
+}
+
+// VerifyAllStream is like VerifyAll, but rather than stopping at the first
+// failure, it downloads and verifies every index listed in the release, and
+// sends a FileResult for each on the returned channel, which is closed once
+// all indices have been verified, including those not present on the
+// mirror (see FileResult.Err). Pool files are not verified.
+//
+// Indices are verified concurrently, up to the Parallel limit of the
+// Downloader, so results are sent in no particular order. The caller must
+// receive from the channel until it is closed.
+func (r *ReleaseDownloader) VerifyAllStream() <-chan FileResult {
+	indices := r.release.Indices()
+	names := make(chan string)
+	results := make(chan FileResult)
+
+	workers := r.g.Parallel
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				results <- r.verifyIndex(name, indices[name][0])
+			}
+		}()
+	}
+
+	go func() {
+		sorted := make([]string, 0, len(indices))
+		for name := range indices {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+		for _, name := range sorted {
+			names <- name
+		}
+		close(names)
+		wg.Wait()
+		close(results)
+	}()
+
+	return results
+}
+
+// verifyIndex downloads and verifies the index name of the release, and
+// returns the outcome.
+func (r *ReleaseDownloader) verifyIndex(name string, fh control.FileHash) FileResult {
+	result := FileResult{
+		Filename:  name,
+		Algorithm: fh.Algorithm,
+		Expected:  fh.Hash,
+	}
+
+	fn := r.indexPath(fh)
+	verifier, err := r.g.verifier(fh, r.mirror, fn)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	hasher, err := hashio.NewHasher(fh.Algorithm)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	recorder := &resultVerifier{WriteCloser: verifier, hasher: hasher}
+
+	decompressor := decompressorFor(filepath.Ext(fh.Filename))
+	f, err := r.g.tempFileWithFilename(context.Background(), recorder, decompressor, r.mirror, fn, "")
+	if recorder.closed {
+		result.Actual = fmt.Sprintf("%x", hasher.Sum(nil))
+		result.Size = hasher.Size()
+	}
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return result
+}
+
+// resultVerifier wraps a verifier, hashing the data written to it, so the
+// hash can be reported even if verification fails.
+type resultVerifier struct {
+	io.WriteCloser
+
+	hasher *hashio.Hasher
+	closed bool
+}
+
+func (v *resultVerifier) setURL(u string) {
+	if m, ok := v.WriteCloser.(sourceRecorder); ok {
+		m.setURL(u)
+	}
+}
+
+func (v *resultVerifier) setCached() {
+	if m, ok := v.WriteCloser.(sourceRecorder); ok {
+		m.setCached()
+	}
+}
+
+func (v *resultVerifier) Write(p []byte) (int, error) {
+	v.hasher.Write(p)
+	return v.WriteCloser.Write(p)
+}
+
+func (v *resultVerifier) Close() error {
+	v.closed = true
+	return v.WriteCloser.Close()
+}
+
+// verifyPoolFiles downloads and verifies every pool file referenced by the
+// Packages or Sources index f. Any other kind of index is ignored. Pool
+// files which are in seen are skipped, and all files verified are added to
+// seen.
+func (r *ReleaseDownloader) verifyPoolFiles(kind string, f *os.File, seen map[string]bool) error {
+	fhs := []control.FileHash{}
+
+	switch kind {
+	case "Packages":
+		packages, err := LoadPackages(f)
+		if err != nil {
+			return err
+		}
+		for {
+			pkg, err := packages.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			fhs = append(fhs, pkg.poolFileHash())
+		}
+	case "Sources":
+		sources, err := LoadSources(f)
+		if err != nil {
+			return err
+		}
+		for {
+			src, err := sources.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			for _, fh := range src.ChecksumsSha256 {
+				fh.Filename = path.Join(src.Directory, fh.Filename)
+				fhs = append(fhs, fh.FileHash)
+			}
+		}
+	}
+
+	for _, fh := range fhs {
+		if seen[fh.Filename] {
+			continue
+		}
+		seen[fh.Filename] = true
+
+		f, err := r.poolTempFile(fh, "")
+		if err != nil {
+			return fmt.Errorf("verify(%s): %v", fh.Filename, err)
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+	return nil
+}
+
+// indexExtensions lists the extensions of the compressed (or uncompressed)
+// variants of an index, in the order they are preferred by indexTempFile.
+var indexExtensions = []string{".xz", ".zst", ".gz", ".bz2", ""}
+
+// indexTempFile is like TempFile, but for the index base (e.g.
+// "main/binary-amd64/Packages") in whichever compressed variant the release
+// lists and the mirror has, see indexExtensions. The file returned is always
+// decompressed.
+func (r *ReleaseDownloader) indexTempFile(base string) (*os.File, error) {
+	indices := r.release.Indices()
+	for _, ext := range indexExtensions {
+		fhs, ok := indices[base+ext]
+		if !ok {
+			continue
+		}
+		f, err := r.TempFile(fhs[0])
+		if isNotFound(err) {
+			continue
+		}
+		return f, err
+	}
+	return nil, notFoundError{fmt.Errorf("%s: no such index in %s", base, r.suite)}
+}
+
+// FetchPackage downloads and verifies the .deb of the binary package name at
+// version ver for arch, finding it in the Packages index for arch of each
+// Component of the release in turn. If no such package exists, an error for
+// which IsNotFound is true is returned.
+//
+// If err is nil, the caller must call the returned function once done with
+// the .deb, to close and remove the downloaded file.
+func (r *ReleaseDownloader) FetchPackage(name string, ver version.Version, arch dependency.Arch) (*deb.Deb, func() error, error) {
+	for _, component := range r.release.Components {
+		pkg, err := r.findPackage(component, name, ver, arch)
+		if isNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		fh := pkg.poolFileHash()
+		f, err := r.poolTempFile(fh, cacheKey(fh))
+		if err != nil {
+			return nil, nil, err
+		}
+		closer := func() error {
+			defer os.Remove(f.Name())
+			return f.Close()
+		}
+
+		debFile, err := deb.Load(f, f.Name())
+		if err != nil {
+			closer()
+			return nil, nil, err
+		}
+		return debFile, closer, nil
+	}
+	return nil, nil, notFoundError{fmt.Errorf(
+		"%s_%s_%s: no such package in %s", name, ver, arch, r.suite,
+	)}
+}
+
+// Sources downloads and verifies the Sources index of component, in
+// whichever compressed variant the release lists and the mirror has, and
+// returns an iterator over it. The temporary file it's read from is removed
+// once the iterator returns io.EOF, or is closed with Sources.Close.
+func (r *ReleaseDownloader) Sources(component string) (*Sources, error) {
+	f, err := r.indexTempFile(sourceIndexPath(component))
+	if err != nil {
+		return nil, err
+	}
+	closer := func() error {
+		defer os.Remove(f.Name())
+		return f.Close()
+	}
+
+	sources, err := LoadSources(f)
+	if err != nil {
+		closer()
+		return nil, err
+	}
+	sources.closer = closer
+	return sources, nil
+}
+
+// Packages downloads and verifies the Packages index for arch of component,
+// in whichever compressed variant the release lists and the mirror has, and
+// returns an iterator over it, with the Component of each Package set. The
+// temporary file it's read from is removed once the iterator returns
+// io.EOF, or is closed with Packages.Close.
+func (r *ReleaseDownloader) Packages(component string, arch dependency.Arch) (*Packages, error) {
+	f, err := r.indexTempFile(binaryIndexPath(component, arch))
+	if err != nil {
+		return nil, err
+	}
+	closer := func() error {
+		defer os.Remove(f.Name())
+		return f.Close()
+	}
+
+	packages, err := LoadComponentPackages(f, component)
+	if err != nil {
+		closer()
+		return nil, err
+	}
+	packages.closer = closer
+	return packages, nil
+}
+
+// findPackage returns the entry for the binary package name at version ver
+// from the Packages index for arch of component.
+func (r *ReleaseDownloader) findPackage(component, name string, ver version.Version, arch dependency.Arch) (*Package, error) {
+	packages, err := r.Packages(component, arch)
+	if err != nil {
+		return nil, err
+	}
+	defer packages.Close()
+
+	for {
+		pkg, err := packages.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if pkg.Package == name && version.Compare(pkg.Version, ver) == 0 &&
+			(pkg.Architecture.String() == arch.String() || pkg.Architecture.String() == "all") {
+			return pkg, nil
+		}
+	}
+	return nil, notFoundError{fmt.Errorf("%s_%s_%s: not in %s", name, ver, arch, component)}
+}
+
+// ManifestEntry describes a single file which was downloaded and verified by
+// a Downloader with RecordManifest set.
+type ManifestEntry struct {
+	// URL the file was downloaded from (or its path, for a LocalMirror).
+	// For a file read from the Cache, this is the URL it would have been
+	// downloaded from.
+	URL string `json:"url"`
+
+	// Cached is set if the file was read from the Cache, rather than
+	// downloaded.
+	Cached bool `json:"cached,omitempty"`
+
+	// Algorithm of the Expected and Actual hashes, e.g. "sha256".
+	Algorithm string `json:"algorithm"`
+
+	// Hash of the file as declared by the Release or index it came from.
+	Expected string `json:"expected"`
+
+	// Hash of the file as downloaded.
+	Actual string `json:"actual"`
+
+	// Size of the file as downloaded, in bytes.
+	Size int64 `json:"size"`
+}
+
+// Manifest returns a record of every file downloaded and verified so far, in
+// the order in which they were verified. Nothing is recorded unless
+// RecordManifest is set.
+func (g *Downloader) Manifest() []ManifestEntry {
+	g.manifestMu.Lock()
+	defer g.manifestMu.Unlock()
+	return append([]ManifestEntry{}, g.manifest...)
+}
+
+// verifier returns an io.WriteCloser which verifies data downloaded from fn
+// (on mirror, see url) against fh. If RecordManifest is set, the download is
+// recorded in the manifest once it has been verified.
+func (g *Downloader) verifier(fh control.FileHash, mirror, fn string) (io.WriteCloser, error) {
 	verifier, err := fh.Verifier()
 	if err != nil {
 		return nil, err
 	}
-	decompressor := deb.DecompressorFor(filepath.Ext(fh.Filename))
-	return r.g.tempFileWithFilename(verifier, decompressor, fn)
+	if !g.RecordManifest {
+		return verifier, nil
+	}
+	hasher, err := hashio.NewHasher(fh.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &manifestVerifier{
+		WriteCloser: verifier,
+		hasher:      hasher,
+		g:           g,
+		entry: ManifestEntry{
+			URL:       g.url(mirror, fn),
+			Algorithm: fh.Algorithm,
+			Expected:  fh.Hash,
+		},
+	}, nil
+}
+
+// manifestVerifier wraps a verifier, recording the data written to it in the
+// Downloader's manifest once the verifier has been successfully closed.
+type manifestVerifier struct {
+	io.WriteCloser
+
+	hasher *hashio.Hasher
+	g      *Downloader
+	entry  ManifestEntry
+}
+
+// A sourceRecorder is a verifier which is told where the data written to it
+// actually came from, which is only known once the download has started:
+// either the URL it was downloaded from (see Mirrors), or the Cache.
+type sourceRecorder interface {
+	setURL(u string)
+	setCached()
+}
+
+func (m *manifestVerifier) setURL(u string) {
+	m.entry.URL = u
+}
+
+func (m *manifestVerifier) setCached() {
+	m.entry.Cached = true
+}
+
+func (m *manifestVerifier) Write(p []byte) (int, error) {
+	m.hasher.Write(p)
+	return m.WriteCloser.Write(p)
+}
+
+func (m *manifestVerifier) Close() error {
+	if err := m.WriteCloser.Close(); err != nil {
+		return err
+	}
+	m.entry.Actual = fmt.Sprintf("%x", m.hasher.Sum(nil))
+	m.entry.Size = m.hasher.Size()
+
+	m.g.manifestMu.Lock()
+	defer m.g.manifestMu.Unlock()
+	m.g.manifest = append(m.g.manifest, m.entry)
+	return nil
 }
 
 type noopVerifier struct{}
@@ -273,28 +1292,31 @@ func (*noopVerifier) Close() error              { return nil }
 // If cryptographic verification using DebianArchiveKeyring fails, an error will
 // be returned.
 func (g *Downloader) Release(suite string) (*Release, *ReleaseDownloader, error) {
+	return g.ReleaseContext(context.Background(), suite)
+}
+
+// ReleaseContext is like Release, but the download of the release metadata
+// is aborted if ctx is done before it completes.
+func (g *Downloader) ReleaseContext(ctx context.Context, suite string) (*Release, *ReleaseDownloader, error) {
 	if err := g.init(); err != nil {
 		return nil, nil, err
 	}
 
-	u := "dists/" + suite + "/InRelease"
-	if strings.HasSuffix(suite, "stable") {
-		// Only testing (buster) has InRelease at this point, so fall back to
-		// Release for *stable:
-		u = "dists/" + suite + "/Release"
-	}
-	verifier := &noopVerifier{}             // verification happens in LoadInRelease
-	decompressor := deb.DecompressorFor("") // InRelease is not compressed
-	f, err := g.tempFileWithFilename(verifier, decompressor, u)
+	// Not every archive ships both an InRelease and a Release/Release.gpg
+	// pair, so prefer InRelease, and only fall back to the detached signature
+	// if the archive doesn't have one.
+	r, f, err := g.inRelease(ctx, suite)
+	if isNotFound(err) {
+		r, f, err = g.detachedRelease(ctx, suite)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
 	defer os.Remove(f.Name())
 	defer f.Close()
 
-	r, err := LoadInRelease(f, &g.Keyring)
-	if err != nil {
-		return nil, nil, fmt.Errorf("LoadInRelease(%s): %v", u, err)
+	if err := g.checkRelease(suite, r); err != nil {
+		return nil, nil, err
 	}
 
 	fi, err := f.Stat()
@@ -302,7 +1324,126 @@ func (g *Downloader) Release(suite string) (*Release, *ReleaseDownloader, error)
 		return nil, nil, err
 	}
 
-	return r, &ReleaseDownloader{fi.ModTime(), r.AcquireByHash, g, suite}, nil
+	return r, &ReleaseDownloader{
+		LastModified:  fi.ModTime(),
+		acquireByHash: r.AcquireByHash,
+		g:             g,
+		suite:         suite,
+		mirror:        g.suiteMirror(suite),
+		release:       r,
+	}, nil
+}
+
+// ReleaseVerificationError is returned by Release when the release metadata
+// of a suite was downloaded, but could not be verified against the Keyring
+// (or could not be parsed), as opposed to not being there at all.
+type ReleaseVerificationError struct {
+	// Filename is the path of the file that failed to verify, relative to
+	// the root of the mirror, e.g. "dists/unstable/InRelease".
+	Filename string
+	Err      error
+}
+
+func (e *ReleaseVerificationError) Error() string {
+	return fmt.Sprintf("verify(%s): %v", e.Filename, e.Err)
+}
+
+// Available reports whether suite is present on the mirror, and has release
+// metadata signed by a key in the Keyring. No indices are downloaded, so
+// this is a cheap check, such as for picking a mirror.
+//
+// If the suite is not present, false and a nil error are returned. If it is
+// present but can't be verified, the error is a *ReleaseVerificationError.
+func (g *Downloader) Available(suite string) (bool, error) {
+	if _, _, err := g.Release(suite); err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// releaseOptions returns the ReleaseOptions used to load release metadata.
+func (g *Downloader) releaseOptions() ReleaseOptions {
+	return ReleaseOptions{
+		RejectExpiredKeys:  g.RejectExpiredKeys,
+		AllowExpiredKeys:   g.AllowExpiredKeys,
+		Clock:              g.now,
+		PinnedFingerprints: g.PinnedFingerprints,
+	}
+}
+
+// releaseVerifier returns the ReleaseVerifier used to check release metadata,
+// which is Verifier if set, or the Keyring otherwise.
+func (g *Downloader) releaseVerifier() ReleaseVerifier {
+	if g.Verifier != nil {
+		return g.Verifier
+	}
+	return OpenPGPVerifier{Keyring: g.Keyring, Options: g.releaseOptions()}
+}
+
+// checkRelease returns an error if r, the Release of suite, doesn't match
+// ExpectOrigin and ExpectLabel, or has expired and RejectExpired is set.
+func (g *Downloader) checkRelease(suite string, r *Release) error {
+	if g.ExpectOrigin != "" && r.Origin != g.ExpectOrigin {
+		return fmt.Errorf("Release(%s): Origin is %q, expected %q", suite, r.Origin, g.ExpectOrigin)
+	}
+	if g.ExpectLabel != "" && r.Label != g.ExpectLabel {
+		return fmt.Errorf("Release(%s): Label is %q, expected %q", suite, r.Label, g.ExpectLabel)
+	}
+	if g.RejectExpired && r.IsExpired(g.now()) {
+		return &ReleaseExpiredError{Suite: suite, ValidUntil: r.ValidUntil}
+	}
+	return nil
+}
+
+// inRelease downloads and verifies the InRelease file of suite, returning
+// the parsed Release as well as the downloaded file.
+func (g *Downloader) inRelease(ctx context.Context, suite string) (*Release, *os.File, error) {
+	u := "dists/" + suite + "/InRelease"
+	verifier := &noopVerifier{}         // verification happens in LoadInRelease
+	decompressor := decompressorFor("") // InRelease is not compressed
+	f, err := g.tempFileWithFilename(ctx, verifier, decompressor, g.suiteMirror(suite), u, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r, err := LoadInReleaseWithVerifier(f, g.releaseVerifier(), g.releaseOptions())
+	if err != nil {
+		os.Remove(f.Name())
+		f.Close()
+		return nil, nil, &ReleaseVerificationError{Filename: u, Err: err}
+	}
+	return r, f, nil
+}
+
+// detachedRelease downloads the Release file of suite, and verifies it
+// against the detached signature in Release.gpg, returning the parsed Release
+// as well as the downloaded Release file.
+func (g *Downloader) detachedRelease(ctx context.Context, suite string) (*Release, *os.File, error) {
+	u := "dists/" + suite + "/Release"
+	verifier := &noopVerifier{}         // verification happens in LoadRelease
+	decompressor := decompressorFor("") // Release is not compressed
+	sig, err := g.tempFileWithFilename(ctx, verifier, decompressor, g.suiteMirror(suite), u+".gpg", "")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(sig.Name())
+	defer sig.Close()
+
+	f, err := g.tempFileWithFilename(ctx, verifier, decompressor, g.suiteMirror(suite), u, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r, err := LoadReleaseWithVerifier(f, sig, g.releaseVerifier(), g.releaseOptions())
+	if err != nil {
+		os.Remove(f.Name())
+		f.Close()
+		return nil, nil, &ReleaseVerificationError{Filename: u, Err: err}
+	}
+	return r, f, nil
 }
 
 // DefaultDownloader is a ready-to-use Downloader, used by convenience wrappers
@@ -313,37 +1454,40 @@ var DefaultDownloader = &Downloader{
 	Mirror:              "https://deb.debian.org/debian",
 }
 
+// cachedRelease is an entry of the releaseCache. done is closed once the
+// Release has been loaded, after which r, rd and err may be read.
 type cachedRelease struct {
-	r   *Release
-	rd  *ReleaseDownloader
-	err error
+	done chan struct{}
+	r    *Release
+	rd   *ReleaseDownloader
+	err  error
 }
 
 var (
 	releaseCacheMu sync.Mutex
-	releaseCache   = make(map[string]cachedRelease)
+	releaseCache   = make(map[string]*cachedRelease)
 )
 
 // CachedRelease returns DefaultDownloader.Release(suite), caching releases for
 // the duration of the process.
+//
+// Concurrent calls for the same suite share a single download, and calls for
+// different suites don't wait on each other.
 func CachedRelease(suite string) (*Release, *ReleaseDownloader, error) {
 	releaseCacheMu.Lock()
 	cached, ok := releaseCache[suite]
-	releaseCacheMu.Unlock()
-	if ok {
-		return cached.r, cached.rd, cached.err
+	if !ok {
+		cached = &cachedRelease{done: make(chan struct{})}
+		releaseCache[suite] = cached
 	}
+	releaseCacheMu.Unlock()
 
-	r, rd, err := DefaultDownloader.Release(suite)
-	releaseCacheMu.Lock()
-	defer releaseCacheMu.Unlock()
-	if cached, ok := releaseCache[suite]; ok {
-		// Another goroutine raced us, return cached values for consistency:
-		return cached.r, cached.rd, cached.err
+	if !ok {
+		cached.r, cached.rd, cached.err = DefaultDownloader.Release(suite)
+		close(cached.done)
 	}
-
-	releaseCache[suite] = cachedRelease{r, rd, err}
-	return r, rd, err
+	<-cached.done
+	return cached.r, cached.rd, cached.err
 }
 
 // TempFile expects a path starting with dists/<suite>, calls Release(suite),
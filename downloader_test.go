@@ -0,0 +1,443 @@
+package archive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"pault.ag/go/debian/control"
+)
+
+// Test Helpers {{{
+
+// When the files served by newTestMirror were last modified.
+var testMirrorModified = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Serve the given files, counting the requests made in hits.
+func testMirrorHandler(files map[string]string, hits *int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if hits != nil {
+			atomic.AddInt64(hits, 1)
+		}
+		data, ok := files[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		http.ServeContent(w, req, req.URL.Path, testMirrorModified, strings.NewReader(data))
+	})
+}
+
+// Serve the given files over HTTP for the rest of the test, counting the
+// requests made in hits.
+func newTestMirror(t testing.TB, files map[string]string, hits *int64) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(testMirrorHandler(files, hits))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// Get the FileHash of data, stored at fn.
+func testFileHash(fn, data string) control.FileHash {
+	sum := sha256.Sum256([]byte(data))
+	return control.FileHash{
+		Algorithm: "sha256",
+		Hash:      hex.EncodeToString(sum[:]),
+		Size:      int64(len(data)),
+		Filename:  fn,
+	}
+}
+
+// Download fh with g, and return what was downloaded.
+func readTestFile(t testing.TB, g *Downloader, fh control.FileHash) string {
+	t.Helper()
+	f, err := g.TempFile(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// }}}
+
+// Cache {{{
+
+func TestDownloaderCorruptCache(t *testing.T) {
+	const packages = "Package: hello\nVersion: 1.0-1\n"
+	fh := testFileHash("dists/unstable/main/binary-amd64/Packages", packages)
+
+	var hits int64
+	srv := newTestMirror(t, map[string]string{"/" + fh.Filename: packages}, &hits)
+	cache := DirCache(t.TempDir())
+	if err := ioutil.WriteFile(filepath.Join(string(cache), cacheKey(fh)), []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	progressed := 0
+	g := &Downloader{
+		Parallel: 1,
+		Mirror:   srv.URL,
+		Cache:    cache,
+		Keyring:  openpgp.EntityList{},
+		Progress: func(downloaded, total int64) { progressed++ },
+	}
+
+	if got := readTestFile(t, g, fh); got != packages {
+		t.Fatalf("Downloaded %q, not %q", got, packages)
+	}
+	if hits != 1 {
+		t.Errorf("The corrupt file in the Cache was not downloaded again")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(string(cache), cacheKey(fh))); err != nil || string(data) != packages {
+		t.Errorf("The Cache holds %q (%v), not the file downloaded again", data, err)
+	}
+
+	progressed = 0
+	if got := readTestFile(t, g, fh); got != packages {
+		t.Fatalf("Read %q from the Cache, not %q", got, packages)
+	}
+	if hits != 1 {
+		t.Errorf("The file was downloaded again, rather than read from the Cache")
+	}
+	if progressed != 0 {
+		t.Errorf("Progress was called for a file read from the Cache")
+	}
+}
+
+// Put data into cache under the key of fh.
+func putTestCache(t testing.TB, cache Cache, fh control.FileHash, data string) {
+	t.Helper()
+	if err := cache.Put(cacheKey(fh), strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Get a ReleaseDownloader for the suite unstable of g, listing fhs.
+func newTestReleaseDownloader(t testing.TB, g *Downloader, fhs ...control.FileHash) *ReleaseDownloader {
+	t.Helper()
+	if err := g.init(); err != nil {
+		t.Fatal(err)
+	}
+	release := &Release{}
+	for _, fh := range fhs {
+		release.SHA256 = append(release.SHA256, control.SHA256FileHash{FileHash: fh})
+	}
+	return &ReleaseDownloader{g: g, suite: "unstable", release: release}
+}
+
+func TestVerifyAllIgnoresCache(t *testing.T) {
+	const packages = "Package: hello\nVersion: 1.0-1\n"
+	fh := testFileHash("main/binary-amd64/Packages", packages)
+	srv := newTestMirror(t, map[string]string{"/dists/unstable/" + fh.Filename: "corrupt"}, nil)
+	cache := DirCache(t.TempDir())
+	putTestCache(t, cache, fh, packages)
+
+	g := &Downloader{Parallel: 1, Mirror: srv.URL, Cache: cache, Keyring: openpgp.EntityList{}}
+	r := newTestReleaseDownloader(t, g, fh)
+	if err := r.VerifyAll(false); err == nil {
+		t.Errorf("VerifyAll passed a corrupt mirror, going by the Cache")
+	}
+}
+
+func TestManifestCached(t *testing.T) {
+	const packages = "Package: hello\nVersion: 1.0-1\n"
+	fh := testFileHash("dists/unstable/main/binary-amd64/Packages", packages)
+	srv := newTestMirror(t, map[string]string{}, nil)
+	cache := DirCache(t.TempDir())
+	putTestCache(t, cache, fh, packages)
+
+	g := &Downloader{
+		Parallel:       1,
+		Mirror:         srv.URL,
+		Cache:          cache,
+		Keyring:        openpgp.EntityList{},
+		RecordManifest: true,
+	}
+	readTestFile(t, g, fh)
+
+	manifest := g.Manifest()
+	if len(manifest) != 1 {
+		t.Fatalf("Manifest has %d entries, not 1", len(manifest))
+	}
+	if !manifest[0].Cached {
+		t.Errorf("The manifest doesn't record that the file was read from the Cache")
+	}
+	if want := srv.URL + "/" + fh.Filename; manifest[0].URL != want {
+		t.Errorf("Manifest URL is %q, not %q", manifest[0].URL, want)
+	}
+}
+
+// }}}
+
+// Connections {{{
+
+func TestDownloaderReusesConnections(t *testing.T) {
+	files := map[string]string{}
+	fhs := []control.FileHash{}
+	for _, arch := range []string{"amd64", "arm64", "i386", "riscv64"} {
+		data := "Package: hello\nArchitecture: " + arch + "\n"
+		fh := testFileHash("dists/unstable/main/binary-"+arch+"/Packages", data)
+		files["/"+fh.Filename] = data
+		fhs = append(fhs, fh)
+	}
+	var dialed int64
+	srv := httptest.NewUnstartedServer(testMirrorHandler(files, nil))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&dialed, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	g := &Downloader{Parallel: 1, Mirror: srv.URL, Keyring: openpgp.EntityList{}}
+	for _, fh := range fhs {
+		readTestFile(t, g, fh)
+	}
+	if n := atomic.LoadInt64(&dialed); n != 1 {
+		t.Errorf("%d connections were dialed for %d files, not 1", n, len(fhs))
+	}
+}
+
+// }}}
+
+// Mirrors {{{
+
+func TestManifestFailoverURL(t *testing.T) {
+	const packages = "Package: hello\nVersion: 1.0-1\n"
+	fh := testFileHash("dists/unstable/main/binary-amd64/Packages", packages)
+	partial := newTestMirror(t, map[string]string{}, nil)
+	full := newTestMirror(t, map[string]string{"/" + fh.Filename: packages}, nil)
+
+	g := &Downloader{
+		Parallel:       1,
+		Mirrors:        []string{partial.URL, full.URL},
+		Keyring:        openpgp.EntityList{},
+		RecordManifest: true,
+	}
+	readTestFile(t, g, fh)
+
+	manifest := g.Manifest()
+	if len(manifest) != 1 {
+		t.Fatalf("Manifest has %d entries, not 1", len(manifest))
+	}
+	if want := full.URL + "/" + fh.Filename; manifest[0].URL != want {
+		t.Errorf("Manifest URL is %q, not %q, which served the file", manifest[0].URL, want)
+	}
+}
+
+// }}}
+
+// VerifyAllStream {{{
+
+func TestVerifyAllStreamNotFound(t *testing.T) {
+	const packages = "Package: hello\nVersion: 1.0-1\n"
+	served := testFileHash("main/binary-amd64/Packages", packages)
+	missing := testFileHash("main/binary-arm64/Packages", packages)
+	srv := newTestMirror(t, map[string]string{"/dists/unstable/" + served.Filename: packages}, nil)
+
+	g := &Downloader{Parallel: 2, Mirror: srv.URL, Keyring: openpgp.EntityList{}}
+	r := newTestReleaseDownloader(t, g, served, missing)
+
+	results := map[string]FileResult{}
+	for result := range r.VerifyAllStream() {
+		results[result.Filename] = result
+	}
+	if result, ok := results[served.Filename]; !ok || result.Err != nil {
+		t.Errorf("%s was not verified: %v", served.Filename, result.Err)
+	}
+	if result, ok := results[missing.Filename]; !ok {
+		t.Errorf("No result was sent for %s, which is not on the mirror", missing.Filename)
+	} else if !IsNotFound(result.Err) {
+		t.Errorf("%s is not on the mirror, but got %v", missing.Filename, result.Err)
+	}
+}
+
+func TestVerifyAllStreamIgnoresCache(t *testing.T) {
+	const packages = "Package: hello\nVersion: 1.0-1\n"
+	fh := testFileHash("main/binary-amd64/Packages", packages)
+	srv := newTestMirror(t, map[string]string{"/dists/unstable/" + fh.Filename: "corrupt"}, nil)
+	cache := DirCache(t.TempDir())
+	putTestCache(t, cache, fh, packages)
+
+	g := &Downloader{Parallel: 1, Mirror: srv.URL, Cache: cache, Keyring: openpgp.EntityList{}}
+	r := newTestReleaseDownloader(t, g, fh)
+	for result := range r.VerifyAllStream() {
+		if result.Err == nil {
+			t.Errorf("%s passed on a corrupt mirror, going by the Cache", result.Filename)
+		}
+		if result.Actual == fh.Hash {
+			t.Errorf("%s was hashed from the Cache, not the mirror", result.Filename)
+		}
+	}
+}
+
+// }}}
+
+// CachedRelease {{{
+
+// A ReleaseVerifier which accepts anything, for release metadata which isn't
+// actually signed.
+type acceptingVerifier struct{}
+
+func (acceptingVerifier) VerifyInline(signed []byte) ([]byte, error) { return signed, nil }
+func (acceptingVerifier) VerifyDetached(data, sig []byte) error      { return nil }
+
+// Best run with -race, as the releaseCache is shared between goroutines.
+func TestCachedReleaseConcurrent(t *testing.T) {
+	suites := []string{"stable", "unstable"}
+
+	// Hold every request until each suite has been asked for, so loads of
+	// different suites which wait on each other never finish.
+	var mu sync.Mutex
+	hits := map[string]int{}
+	all := make(chan struct{})
+	stuck := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		hits[req.URL.Path]++
+		if len(hits) == len(suites) {
+			close(all)
+		}
+		mu.Unlock()
+		select {
+		case <-all:
+		case <-time.After(5 * time.Second):
+			mu.Lock()
+			stuck = true
+			mu.Unlock()
+		}
+		suite := strings.Split(req.URL.Path, "/")[2]
+		http.ServeContent(w, req, req.URL.Path, testMirrorModified, strings.NewReader("Suite: "+suite+"\n"))
+	}))
+	defer srv.Close()
+
+	defaultDownloader, cache := DefaultDownloader, releaseCache
+	defer func() { DefaultDownloader, releaseCache = defaultDownloader, cache }()
+	DefaultDownloader = &Downloader{Parallel: 10, Mirror: srv.URL, Verifier: acceptingVerifier{}}
+	releaseCache = make(map[string]*cachedRelease)
+
+	var wg sync.WaitGroup
+	releases := make([][]*ReleaseDownloader, len(suites))
+	for i, suite := range suites {
+		releases[i] = make([]*ReleaseDownloader, 8)
+		for j := range releases[i] {
+			wg.Add(1)
+			go func(suite string, rd **ReleaseDownloader) {
+				defer wg.Done()
+				_, got, err := CachedRelease(suite)
+				if err != nil {
+					t.Error(err)
+				}
+				*rd = got
+			}(suite, &releases[i][j])
+		}
+	}
+	wg.Wait()
+
+	if stuck {
+		t.Errorf("Loading different suites concurrently was serialized")
+	}
+	for i, suite := range suites {
+		if n := hits["/dists/"+suite+"/InRelease"]; n != 1 {
+			t.Errorf("%s was downloaded %d times, not once", suite, n)
+		}
+		for _, rd := range releases[i] {
+			if rd != releases[i][0] {
+				t.Errorf("Concurrent loads of %s returned different releases", suite)
+				break
+			}
+		}
+	}
+}
+
+// }}}
+
+// Redirects {{{
+
+// Make a request for path on srv, with an Authorization header, through the
+// client of g, and return the Authorization header the request ended up
+// with once redirected.
+func redirectedAuthorization(t *testing.T, g *Downloader, srv *httptest.Server, path string, got *string) string {
+	t.Helper()
+	*got = ""
+	req, err := http.NewRequest("GET", srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Basic c2VjcmV0")
+	resp, err := g.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return *got
+}
+
+func TestDownloaderCrossHostRedirect(t *testing.T) {
+	var authorization string
+	record := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authorization = req.Header.Get("Authorization")
+	})
+	other := httptest.NewServer(record)
+	defer other.Close()
+	mux := http.NewServeMux()
+	mux.Handle("/file", record)
+	mux.Handle("/same", http.RedirectHandler("/file", http.StatusFound))
+	mux.Handle("/cross", http.RedirectHandler(other.URL+"/file", http.StatusFound))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	redirects := 0
+	for _, test := range []struct {
+		name   string
+		client *http.Client
+	}{
+		{"default client", nil},
+		{"HTTPClient", &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				redirects++
+				return nil
+			},
+		}},
+	} {
+		g := &Downloader{
+			Parallel:   1,
+			Mirror:     srv.URL,
+			Keyring:    openpgp.EntityList{},
+			HTTPClient: test.client,
+		}
+		if err := g.init(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := redirectedAuthorization(t, g, srv, "/same", &authorization); got == "" {
+			t.Errorf("%s: Authorization was dropped on a same-host redirect", test.name)
+		}
+		if got := redirectedAuthorization(t, g, srv, "/cross", &authorization); got != "" {
+			t.Errorf("%s: Authorization %q was sent to another host", test.name, got)
+		}
+	}
+	if redirects != 2 {
+		t.Errorf("The CheckRedirect of the HTTPClient was called %d times, not 2", redirects)
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,205 @@
+package archive
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"pault.ag/go/blobstore"
+	"pault.ag/go/debian/control"
+)
+
+// ExportFlat {{{
+
+// Export a Suite as a standalone "flat" repository (one without a dists
+// directory, used by apt as "deb http://example.com/repo ./") into the
+// directory root.
+//
+// The Packages indices of every Component and Architecture of the Suite are
+// merged into a single Packages (and Packages.gz) file at the top of root,
+// which are covered by a signed Release, Release.gpg and InRelease. Every
+// pool file referenced by the Packages index is copied into root at the same
+// path it has in the Archive, so the pool files must already be linked into
+// the Archive.
+//
+// This is useful to create a small, portable, self-contained snapshot of a
+// Suite, such as for serving on its own or burning to media.
+func (a Archive) ExportFlat(suite Suite, root string) error {
+	files, err := a.Engross(suite)
+	if err != nil {
+		return err
+	}
+
+	indices := []string{}
+	for filePath := range files {
+		if strings.HasSuffix(filePath, "/Packages") {
+			indices = append(indices, filePath)
+		}
+	}
+	sort.Strings(indices)
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+
+	packagesFile, err := os.Create(filepath.Join(root, "Packages"))
+	if err != nil {
+		return err
+	}
+	defer packagesFile.Close()
+
+	gzFile, err := os.Create(filepath.Join(root, "Packages.gz"))
+	if err != nil {
+		return err
+	}
+	defer gzFile.Close()
+
+	hashWriter, hashers, err := getHashers(&suite)
+	if err != nil {
+		return err
+	}
+	gzHashWriter, gzHashers, err := getHashers(&suite)
+	if err != nil {
+		return err
+	}
+	gzWriter := gzip.NewWriter(io.MultiWriter(gzFile, gzHashWriter))
+
+	encoder, err := control.NewEncoder(io.MultiWriter(packagesFile, hashWriter, gzWriter))
+	if err != nil {
+		return err
+	}
+
+	for _, index := range indices {
+		if err := a.exportFlatIndex(files[index], encoder, root); err != nil {
+			return err
+		}
+	}
+
+	if err := gzWriter.Close(); err != nil {
+		return err
+	}
+
+	release, err := newRelease(suite, a.now())
+	if err != nil {
+		return err
+	}
+	release.Architectures = suite.Architectures()
+	for _, hasher := range hashers {
+		if err := release.AddHash(control.FileHashFromHasher("Packages", *hasher)); err != nil {
+			return err
+		}
+	}
+	for _, hasher := range gzHashers {
+		if err := release.AddHash(control.FileHashFromHasher("Packages.gz", *hasher)); err != nil {
+			return err
+		}
+	}
+
+	encoded, err := encodeBytes(release)
+	if err != nil {
+		return err
+	}
+	obj, sig, err := a.signedObjects(encoded)
+	if err != nil {
+		return err
+	}
+	inRelease, err := a.clearsignedObject(encoded)
+	if err != nil {
+		return err
+	}
+
+	for name, obj := range map[string]*blobstore.Object{
+		"Release":     obj,
+		"Release.gpg": sig,
+		"InRelease":   inRelease,
+	} {
+		if err := a.exportObject(*obj, filepath.Join(root, name)); err != nil {
+			return err
+		}
+	}
+
+	if err := packagesFile.Close(); err != nil {
+		return err
+	}
+	return gzFile.Close()
+}
+
+// Write every Package entry in the Packages index obj to encoder, and copy
+// the pool file of each into root.
+func (a Archive) exportFlatIndex(obj blobstore.Object, encoder *control.Encoder, root string) error {
+	fd, err := a.Store.Open(obj)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	packages, err := LoadPackages(fd)
+	if err != nil {
+		return err
+	}
+
+	for {
+		pkg, err := packages.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := encoder.Encode(pkg); err != nil {
+			return err
+		}
+		if err := exportFile(
+			filepath.Join(a.path, pkg.Filename),
+			filepath.Join(root, pkg.Filename),
+		); err != nil {
+			return err
+		}
+	}
+}
+
+// Copy a blobstore Object to the path target on the filesystem.
+func (a Archive) exportObject(obj blobstore.Object, target string) error {
+	fd, err := a.Store.Open(obj)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return exportReader(fd, target)
+}
+
+// Copy the file at source to target, creating any directories as needed.
+func exportFile(source, target string) error {
+	fd, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return exportReader(fd, target)
+}
+
+// Write everything in the io.Reader to target, creating any directories as
+// needed.
+func exportReader(in io.Reader, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// }}}
+
+// vim: foldmethod=marker
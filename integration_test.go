@@ -0,0 +1,134 @@
+package archive
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+
+	"pault.ag/go/debian/dependency"
+	"pault.ag/go/debian/version"
+)
+
+// Round Trip {{{
+
+// Engross and Link a Suite with one package, writing the signature files
+// asked for, and the by-hash indices if acquireByHash is set, and serve the Archive over HTTP for the rest of the test. The
+// key the Archive is signed with is returned along with the server.
+func newServedArchive(t *testing.T, inRelease, detached, acquireByHash bool) (*httptest.Server, *openpgp.Entity) {
+	t.Helper()
+	key, err := openpgp.NewEntity("Test Archive", "", "archive@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(t.TempDir(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	suite, err := a.Suite("unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := suite.SetSignatureFiles(inRelease, detached); err != nil {
+		t.Fatal(err)
+	}
+	suite.SetAcquireByHash(acquireByHash)
+	component, err := suite.Component("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ver, err := version.Parse("1.0-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	arch, err := dependency.ParseArch("amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := component.AddPackage(Package{
+		Package:      "hello",
+		Version:      ver,
+		Architecture: *arch,
+		Maintainer:   "Test Maintainer <maintainer@example.com>",
+		Description:  "Test package hello",
+		Filename:     "pool/main/h/hello/hello_1.0-1_amd64.deb",
+		Size:         1024,
+		SHA256:       "abababababababababababababababababababababababababababababababab",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := a.Engross(*suite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Link(files); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.FileServer(http.Dir(a.Path())))
+	t.Cleanup(srv.Close)
+	return srv, key
+}
+
+// Engross and Link a Suite, serve the Archive over HTTP, and fetch it back
+// with a Downloader, the way apt would. With Acquire-By-Hash, the compressed
+// index is fetched from a by-hash path, which has no extension to tell how
+// it's compressed.
+func TestEngrossDownload(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		inRelease     bool
+		detached      bool
+		acquireByHash bool
+		index         string
+	}{
+		{"InRelease and Release.gpg", true, true, false, "main/binary-amd64/Packages"},
+		{"Release.gpg only", false, true, false, "main/binary-amd64/Packages"},
+		{"Acquire-By-Hash", true, true, true, "main/binary-amd64/Packages.xz"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			srv, key := newServedArchive(t, test.inRelease, test.detached, test.acquireByHash)
+			g := &Downloader{
+				Parallel: 1,
+				Mirror:   srv.URL,
+				Keyring:  openpgp.EntityList{key},
+			}
+			release, rd, err := g.Release("unstable")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if release.AcquireByHash != test.acquireByHash {
+				t.Fatalf("The Release has Acquire-By-Hash: %t", release.AcquireByHash)
+			}
+			fhs, ok := release.Indices()[test.index]
+			if !ok {
+				t.Fatalf("The Release doesn't list %s", test.index)
+			}
+			f, err := rd.TempFile(fhs[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			defer f.Close()
+
+			packages, err := LoadPackages(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pkg, err := packages.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pkg.Package != "hello" || pkg.Version.String() != "1.0-1" {
+				t.Errorf("Downloaded %s %s, not hello 1.0-1", pkg.Package, pkg.Version)
+			}
+		})
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,268 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"pault.ag/go/debian/control"
+)
+
+// OpenSuite {{{
+
+// Get a handle to write a given Suite from an Archive, like Suite, but
+// rather than starting out blank, the Suite is read back from the files
+// linked into the Archive by an earlier Engross, so that packages can be
+// added to it incrementally, and any packages not touched are kept by the
+// next Engross. The settings of the Suite are read back too: the fields of
+// the Release such as Origin and NotAutomatic, Acquire-By-Hash, the hashes
+// there are blocks for, and which of InRelease and Release.gpg are present.
+//
+// The Release of the Suite (the InRelease if there is one, or the Release
+// and Release.gpg otherwise) is checked against the OpenPGP keys this
+// Archive signs with. The Packages and Sources indices are not signed
+// themselves; they are only trusted because they match the hashes in that
+// signed Release, which is checked as they're read. This means anyone who can
+// write to the Archive can't slip in a package without also being able to
+// sign the Release. However, the pool files the indices refer to are not
+// read at all, so they must be trusted as they are on disk.
+//
+// Since OpenSuite reads the indices with the same Component writers that
+// AddPackage and AddSource use, adding a Package or Source which is already
+// in the Suite is an error, and other versions of it are kept alongside,
+// unless removed with Component.RemovePackage first.
+func (a *Archive) OpenSuite(name string) (*Suite, error) {
+	keyring := a.publicKeys()
+	if len(keyring) == 0 {
+		return nil, fmt.Errorf("Archive has no OpenPGP keys to check the Release with, see OpenSuiteWithVerifier")
+	}
+	return a.OpenSuiteWithVerifier(name, OpenPGPVerifier{Keyring: keyring})
+}
+
+// Like OpenSuite, but the signature over the Release is checked by the given
+// ReleaseVerifier, rather than against the OpenPGP keys of the Archive. This
+// is needed when the Archive is signed by Signers that don't hold the key in
+// memory, such as a smartcard or HSM.
+func (a *Archive) OpenSuiteWithVerifier(name string, verifier ReleaseVerifier) (*Suite, error) {
+	release, err := a.openRelease(name, verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	suite, err := a.Suite(name)
+	if err != nil {
+		return nil, err
+	}
+	suite.Codename = release.Codename
+	suite.Description = release.Description
+	suite.Origin = release.Origin
+	suite.Label = release.Label
+	suite.Version = release.Version
+	if err := suite.SetAutomatic(
+		release.NotAutomatic == "yes",
+		release.ButAutomaticUpgrades == "yes",
+	); err != nil {
+		return nil, err
+	}
+	suite.SetAcquireByHash(release.AcquireByHash)
+	if hashes := releaseHashes(*release); len(hashes) != 0 {
+		if err := suite.SetHashes(hashes...); err != nil {
+			return nil, err
+		}
+	}
+	inRelease, detached, err := a.signatureFiles(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := suite.SetSignatureFiles(inRelease, detached); err != nil {
+		return nil, err
+	}
+
+	indices := release.Indices()
+	for _, componentName := range release.Components {
+		component, err := suite.Component(componentName)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := a.openIndex(name, sourceIndexPath(componentName), indices, func(in io.Reader) error {
+			return component.loadSources(in)
+		}); err != nil {
+			return nil, err
+		}
+
+		for _, arch := range release.Architectures {
+			if err := a.openIndex(name, binaryIndexPath(componentName, arch), indices, func(in io.Reader) error {
+				return component.loadPackages(in)
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return suite, nil
+}
+
+// Read and check the signed Release of the Suite `name` from the Archive.
+func (a Archive) openRelease(name string, verifier ReleaseVerifier) (*Release, error) {
+	options := ReleaseOptions{Clock: a.Clock}
+	suiteDir := filepath.Join(a.path, "dists", name)
+
+	inRelease, err := os.Open(filepath.Join(suiteDir, "InRelease"))
+	if err == nil {
+		defer inRelease.Close()
+		return LoadInReleaseWithVerifier(inRelease, verifier, options)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	release, err := os.Open(filepath.Join(suiteDir, "Release"))
+	if err != nil {
+		return nil, err
+	}
+	defer release.Close()
+
+	sig, err := os.Open(filepath.Join(suiteDir, "Release.gpg"))
+	if err != nil {
+		return nil, err
+	}
+	defer sig.Close()
+
+	return LoadReleaseWithVerifier(release, sig, verifier, options)
+}
+
+// Get which of the InRelease, and the Release with its Release.gpg, are in
+// the Suite `name` of the Archive.
+func (a Archive) signatureFiles(name string) (bool, bool, error) {
+	exists := func(fileName string) (bool, error) {
+		_, err := os.Stat(filepath.Join(a.path, "dists", name, fileName))
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	inRelease, err := exists("InRelease")
+	if err != nil {
+		return false, false, err
+	}
+	detached, err := exists("Release.gpg")
+	if err != nil {
+		return false, false, err
+	}
+	return inRelease, detached, nil
+}
+
+// Get the hash algorithms which have a hash block in the Release, as taken
+// by Suite.SetHashes.
+func releaseHashes(release Release) []string {
+	hashes := []string{}
+	if len(release.SHA256) != 0 {
+		hashes = append(hashes, "sha256")
+	}
+	if len(release.SHA1) != 0 {
+		hashes = append(hashes, "sha1")
+	}
+	if len(release.SHA512) != 0 {
+		hashes = append(hashes, "sha512")
+	}
+	if len(release.MD5Sum) != 0 {
+		hashes = append(hashes, "md5")
+	}
+	return hashes
+}
+
+// Read the index `base` (such as "main/binary-amd64/Packages") of the Suite
+// `name` from the Archive, in whichever compressed variant is listed in the
+// Release, passing its decompressed contents to load, and checking it
+// against its hash in the Release. Indices not listed in the Release are
+// skipped.
+func (a Archive) openIndex(
+	name, base string,
+	indices map[string]control.FileHashes,
+	load func(io.Reader) error,
+) error {
+	for _, ext := range indexExtensions {
+		fileHashes, ok := indices[base+ext]
+		if !ok {
+			continue
+		}
+
+		fd, err := os.Open(filepath.Join(a.path, suiteFilePath(name, base+ext)))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		defer fd.Close()
+
+		verifier, err := fileHashes[0].Verifier()
+		if err != nil {
+			return err
+		}
+		in := io.TeeReader(fd, verifier)
+
+		decompressed, err := decompressorFor(ext)(in)
+		if err != nil {
+			return err
+		}
+		defer decompressed.Close()
+
+		if err := load(decompressed); err != nil {
+			return err
+		}
+
+		// Whatever the parser didn't need must still be hashed.
+		if _, err := io.Copy(ioutil.Discard, in); err != nil {
+			return err
+		}
+		if err := verifier.Close(); err != nil {
+			return fmt.Errorf("%s: %v", suiteFilePath(name, base+ext), err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// Add every Package in the Packages index `in` to this Component.
+func (c *Component) loadPackages(in io.Reader) error {
+	packages, err := LoadPackages(in)
+	if err != nil {
+		return err
+	}
+	for {
+		pkg, err := packages.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := c.AddPackage(*pkg); err != nil {
+			return err
+		}
+	}
+}
+
+// Add every Source in the Sources index `in` to this Component.
+func (c *Component) loadSources(in io.Reader) error {
+	sources, err := LoadSources(in)
+	if err != nil {
+		return err
+	}
+	for {
+		source, err := sources.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := c.AddSource(*source); err != nil {
+			return err
+		}
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
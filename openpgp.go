@@ -0,0 +1,488 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// Names of the hash algorithms which may be used for the Archive's
+// signatures, as used in the "Hash" header of a clearsigned message.
+var signatureHashNames = map[crypto.Hash]string{
+	crypto.SHA224: "SHA224",
+	crypto.SHA256: "SHA256",
+	crypto.SHA384: "SHA384",
+	crypto.SHA512: "SHA512",
+}
+
+// Get the hash algorithm to use for signatures made by the Archive, which is
+// SignatureHash, or SHA512 if that's not set.
+func (a Archive) signatureHash() (crypto.Hash, error) {
+	hash := a.SignatureHash
+	if hash == 0 {
+		hash = crypto.SHA512
+	}
+	if _, ok := signatureHashNames[hash]; !ok || !hash.Available() {
+		return 0, fmt.Errorf("Hash %d can not be used for signatures", hash)
+	}
+	return hash, nil
+}
+
+// Signer {{{
+
+// Signer makes the OpenPGP signatures over the Release files of an Archive.
+//
+// An Archive created with New or NewWithSigners signs with in-memory OpenPGP
+// Private Keys, but a Signer can be used to sign with a key which is never
+// loaded into memory at all, such as one on a smartcard or in a cloud KMS,
+// by way of gpg-agent, a PKCS#11 module, or the like.
+type Signer interface {
+	// Get the id of the (sub)key which makes the signatures, as set in
+	// their Issuer subpacket.
+	KeyId() uint64
+
+	// Sign data, returning a serialized (not armored) OpenPGP Signature
+	// packet of the given type (packet.SigTypeBinary or packet.SigTypeText)
+	// made using the hash algorithm h. For a text signature, data has
+	// already been canonicalized, and must be signed exactly as-is.
+	SignDetached(data []byte, sigType packet.SignatureType, h crypto.Hash) ([]byte, error)
+}
+
+// Signer backed by an openpgp.Entity held in memory, which is how an
+// Archive created with New or NewWithSigners signs. The Archive it signs for
+// is set by Archive.signer right before it is used, so that the options set on
+// the Archive (such as SignatureLifetime or Passphrase) apply.
+type entitySigner struct {
+	entity  *openpgp.Entity
+	archive Archive
+}
+
+func (e entitySigner) KeyId() uint64 {
+	return e.archive.signingPrivateKey(e.entity).KeyId
+}
+
+func (e entitySigner) SignDetached(data []byte, sigType packet.SignatureType, h crypto.Hash) ([]byte, error) {
+	sig, err := e.archive.newSignature(e.entity, sigType, h)
+	if err != nil {
+		return nil, err
+	}
+	hash := h.New()
+	hash.Write(data)
+
+	if err := sig.Sign(hash, e.archive.signingPrivateKey(e.entity), &packet.Config{
+		DefaultHash: h,
+	}); err != nil {
+		return nil, err
+	}
+
+	out := bytes.Buffer{}
+	if err := sig.Serialize(&out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// }}}
+
+// Get the private key of the signing key entity used to make signatures,
+// which is the first subkey that's able to sign and has not expired, so the
+// primary key can be kept offline. If there's no such subkey, the primary
+// key is used. Expiry is checked at the time given by the Archive's Clock.
+func (a Archive) signingPrivateKey(entity *openpgp.Entity) *packet.PrivateKey {
+	now := a.now()
+	for _, subkey := range entity.Subkeys {
+		if subkey.PrivateKey == nil || subkey.Sig == nil {
+			continue
+		}
+		if !subkey.Sig.FlagsValid || !subkey.Sig.FlagSign {
+			continue
+		}
+		if expiry, ok := keyExpiry(entity, subkey.PublicKey.KeyId); ok && now.After(expiry) {
+			continue
+		}
+		return subkey.PrivateKey
+	}
+	return entity.PrivateKey
+}
+
+// Get the ids of the keys used to sign the Release files, one for each
+// signing key of the Archive. Each is a signing subkey if the signing key
+// has one; see Archive.signingPrivateKey.
+func (a Archive) SigningKeyIds() ([]uint64, error) {
+	if len(a.signers) == 0 {
+		return nil, fmt.Errorf("No signing key loaded")
+	}
+	ret := []uint64{}
+	for _, signer := range a.signers {
+		ret = append(ret, a.signer(signer).KeyId())
+	}
+	return ret, nil
+}
+
+// Get the OpenPGP keys of the Archive's signers which are held in memory,
+// as a keyring that the Release files signed by them can be checked
+// against. Signers which aren't backed by an openpgp.Entity are left out.
+func (a Archive) publicKeys() openpgp.EntityList {
+	ret := openpgp.EntityList{}
+	for _, signer := range a.signers {
+		if signer, ok := signer.(entitySigner); ok {
+			ret = append(ret, signer.entity)
+		}
+	}
+	return ret
+}
+
+// Decrypt the private keys of the signing key entity (and its subkeys) if
+// they're protected by a passphrase, using the Archive's Passphrase. This is
+// only done right before signing, so an Archive which never signs anything
+// never asks for the passphrase.
+func (a Archive) unlockSigningKey(entity *openpgp.Entity) error {
+	keys := []*packet.PrivateKey{entity.PrivateKey}
+	for _, subkey := range entity.Subkeys {
+		if subkey.PrivateKey != nil {
+			keys = append(keys, subkey.PrivateKey)
+		}
+	}
+
+	var passphrase []byte
+	for _, key := range keys {
+		if !key.Encrypted {
+			continue
+		}
+		if passphrase == nil {
+			if a.Passphrase == nil {
+				return fmt.Errorf("Signing key %s is encrypted, and no Passphrase is set", key.KeyIdString())
+			}
+			var err error
+			if passphrase, err = a.Passphrase(); err != nil {
+				return err
+			}
+		}
+		if err := key.Decrypt(passphrase); err != nil {
+			return fmt.Errorf("Can not decrypt signing key %s: %v", key.KeyIdString(), err)
+		}
+	}
+	return nil
+}
+
+// Create a new OpenPGP Signature packet of the given type, ready to be signed
+// by the private key of the signing key entity using the given hash.
+func (a Archive) newSignature(entity *openpgp.Entity, sigType packet.SignatureType, hash crypto.Hash) (*packet.Signature, error) {
+	if err := a.unlockSigningKey(entity); err != nil {
+		return nil, err
+	}
+
+	key := a.signingPrivateKey(entity)
+	if key.PubKeyAlgo == packet.PubKeyAlgoDSA && hash.Size() < 256/8 {
+		return nil, fmt.Errorf("Hash %s is too small for a DSA signing key", signatureHashNames[hash])
+	}
+
+	sig := new(packet.Signature)
+	sig.SigType = sigType
+	sig.PubKeyAlgo = key.PubKeyAlgo
+
+	sig.Hash = hash
+
+	sig.CreationTime = a.now()
+	sig.IssuerKeyId = &(key.KeyId)
+
+	if a.SignatureLifetime > 0 {
+		// The lifetime is in whole seconds, and is rounded up, since a
+		// lifetime of 0 would mean the signature never expires.
+		secs := (a.SignatureLifetime + time.Second - 1) / time.Second
+		if secs > math.MaxUint32 {
+			return nil, fmt.Errorf("SignatureLifetime %s is too long", a.SignatureLifetime)
+		}
+		lifetime := uint32(secs)
+		sig.SigLifetimeSecs = &lifetime
+	}
+
+	return sig, nil
+}
+
+// Get the Signer to use for this Archive; an entitySigner has the Archive
+// set, so that the options and Clock of the Archive apply to it.
+func (a Archive) signer(signer Signer) Signer {
+	if entity, ok := signer.(entitySigner); ok {
+		entity.archive = a
+		return entity
+	}
+	return signer
+}
+
+// Sign the data with each of the Archive's Signers, writing the Signature
+// packets to out one after another. For a text signature, data must already
+// be canonicalized.
+func (a Archive) sign(out io.Writer, sigType packet.SignatureType, data []byte) error {
+	if len(a.signers) == 0 {
+		return fmt.Errorf("No signing key loaded")
+	}
+	hash, err := a.signatureHash()
+	if err != nil {
+		return err
+	}
+	for _, signer := range a.signers {
+		sig, err := a.signer(signer).SignDetached(data, sigType, hash)
+		if err != nil {
+			return err
+		}
+		if _, err := out.Write(sig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write data to out as an OpenPGP clearsigned message, signed by each of the
+// Archive's signing keys.
+//
+// This does the same thing as clearsign.Encode, but the Signature packets
+// are made by the Archive's Signers (see sign), so that all the options set
+// on the Archive apply to the clearsigned output too, and so that it can be
+// signed by more than one key, or by a key that isn't held in memory.
+func (a Archive) clearsign(out io.Writer, data []byte) error {
+	if len(a.signers) == 0 {
+		return fmt.Errorf("No signing key loaded")
+	}
+	hash, err := a.signatureHash()
+	if err != nil {
+		return err
+	}
+
+	buffered := bufio.NewWriter(out)
+	buffered.WriteString("-----BEGIN PGP SIGNED MESSAGE-----\n")
+	fmt.Fprintf(buffered, "Hash: %s\n\n", signatureHashNames[hash])
+
+	lines := bytes.Split(data, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		// The final newline ends the last line, it doesn't start a new one.
+		lines = lines[:len(lines)-1]
+	}
+
+	canonical := bytes.Buffer{}
+	for i, line := range lines {
+		// The signature is over the text with trailing whitespace removed
+		// and CRLF line endings, without the final line ending, and without
+		// any dash-escaping.
+		if i != 0 {
+			canonical.WriteString("\r\n")
+		}
+		canonical.Write(bytes.TrimRight(line, " \t\r"))
+
+		if bytes.HasPrefix(line, []byte("-")) {
+			buffered.WriteString("- ")
+		}
+		buffered.Write(line)
+		buffered.WriteByte('\n')
+	}
+
+	armored, err := armor.Encode(buffered, "PGP SIGNATURE", nil)
+	if err != nil {
+		return err
+	}
+
+	if err := a.sign(armored, packet.SigTypeText, canonical.Bytes()); err != nil {
+		return err
+	}
+
+	if err := armored.Close(); err != nil {
+		return err
+	}
+
+	return buffered.Flush()
+}
+
+// Check the clearsigned message data against the keyring, returning the
+// signed plaintext, and the Entity that signed it. See checkSignature for the
+// checks done beyond the signature being valid.
+func checkClearsigned(data []byte, keyring openpgp.EntityList, options ReleaseOptions) ([]byte, *openpgp.Entity, error) {
+	block, _ := clearsign.Decode(data)
+	if block == nil {
+		return nil, nil, fmt.Errorf("No clearsigned message found")
+	}
+	sig, err := ioutil.ReadAll(block.ArmoredSignature.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, err := checkSignature(block.Bytes, sig, keyring, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	return block.Plaintext, signer, nil
+}
+
+// Check data against the armored detached signature read from armored,
+// returning the Entity that signed it. See checkSignature for the checks done
+// beyond the signature being valid.
+func checkArmoredDetached(data []byte, armored io.Reader, keyring openpgp.EntityList, options ReleaseOptions) (*openpgp.Entity, error) {
+	block, err := armor.Decode(armored)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type != openpgp.SignatureType {
+		return nil, fmt.Errorf("Expected a %s, got a %s", openpgp.SignatureType, block.Type)
+	}
+	sig, err := ioutil.ReadAll(block.Body)
+	if err != nil {
+		return nil, err
+	}
+	return checkSignature(data, sig, keyring, options)
+}
+
+// Check that the detached signature sig over data was made by a key in the
+// keyring (and in PinnedFingerprints, if set), and that the signature has
+// not expired, returning the Entity that signed it. The key must not have
+// expired either as of when the signature was made, if AllowExpiredKeys is
+// set, or as of now, if only RejectExpiredKeys is.
+func checkSignature(data, sig []byte, keyring openpgp.EntityList, options ReleaseOptions) (*openpgp.Entity, error) {
+	signer, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(data), bytes.NewReader(sig))
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := readSignature(sig, keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	if lifetime := signature.SigLifetimeSecs; lifetime != nil && *lifetime != 0 {
+		expiry := signature.CreationTime.Add(time.Duration(*lifetime) * time.Second)
+		if options.now().After(expiry) {
+			return nil, fmt.Errorf("Signature expired at %s", expiry.Format(time.RFC1123Z))
+		}
+	}
+	if options.RejectExpiredKeys || options.AllowExpiredKeys {
+		when := options.now()
+		if options.AllowExpiredKeys {
+			when = signature.CreationTime
+		}
+		if expiry, ok := keyExpiry(signer, *signature.IssuerKeyId); ok && when.After(expiry) {
+			return nil, fmt.Errorf(
+				"Signing key %X expired at %s",
+				*signature.IssuerKeyId, expiry.Format(time.RFC1123Z),
+			)
+		}
+	}
+	if len(options.PinnedFingerprints) != 0 && !isPinned(signer, *signature.IssuerKeyId, options.PinnedFingerprints) {
+		return nil, fmt.Errorf("Signing key %X is not one of the pinned fingerprints", *signature.IssuerKeyId)
+	}
+	return signer, nil
+}
+
+// Check if the fingerprint of the key of entity with the given key id, or
+// that of its primary key, is one of the pinned fingerprints.
+func isPinned(entity *openpgp.Entity, keyId uint64, pinned []string) bool {
+	fingerprints := []string{hex.EncodeToString(entity.PrimaryKey.Fingerprint[:])}
+	for _, subkey := range entity.Subkeys {
+		if subkey.PublicKey.KeyId == keyId {
+			fingerprints = append(fingerprints, hex.EncodeToString(subkey.PublicKey.Fingerprint[:]))
+		}
+	}
+	for _, pin := range pinned {
+		pin = strings.ToLower(strings.Replace(pin, " ", "", -1))
+		for _, fingerprint := range fingerprints {
+			if pin == fingerprint {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Read the first Signature packet out of sig which was made by a key in the
+// keyring; this is the one that CheckDetachedSignature checks, since sig may
+// hold signatures by more than one key.
+func readSignature(sig []byte, keyring openpgp.EntityList) (*packet.Signature, error) {
+	packets := packet.NewReader(bytes.NewReader(sig))
+	for {
+		p, err := packets.Next()
+		if err != nil {
+			return nil, err
+		}
+		signature, ok := p.(*packet.Signature)
+		if !ok || signature.IssuerKeyId == nil {
+			continue
+		}
+		if len(keyring.KeysById(*signature.IssuerKeyId)) != 0 {
+			return signature, nil
+		}
+	}
+}
+
+// Get the time at which the key (the primary key, or one of the subkeys) of
+// entity with the given key id expires, if it expires at all. A subkey
+// expires when the primary key does, if that's sooner.
+func keyExpiry(entity *openpgp.Entity, keyId uint64) (time.Time, bool) {
+	var (
+		expiry  time.Time
+		expires bool
+	)
+	if selfSignature := primarySelfSignature(entity); selfSignature != nil {
+		lifetime := selfSignature.KeyLifetimeSecs
+		if lifetime != nil && *lifetime != 0 {
+			expiry = entity.PrimaryKey.CreationTime.Add(time.Duration(*lifetime) * time.Second)
+			expires = true
+		}
+	}
+
+	for _, subkey := range entity.Subkeys {
+		if subkey.PublicKey.KeyId != keyId {
+			continue
+		}
+		lifetime := subkey.Sig.KeyLifetimeSecs
+		if lifetime == nil || *lifetime == 0 {
+			break
+		}
+		subkeyExpiry := subkey.PublicKey.CreationTime.Add(time.Duration(*lifetime) * time.Second)
+		if !expires || subkeyExpiry.Before(expiry) {
+			expiry, expires = subkeyExpiry, true
+		}
+	}
+	return expiry, expires
+}
+
+// Get the self-signature of the primary identity of entity, which is the one
+// that sets when the primary key expires: that of the identity flagged as
+// primary, or if none is, the most recent one. Ties are broken by the name of
+// the identity, so the same one is always picked.
+func primarySelfSignature(entity *openpgp.Entity) *packet.Signature {
+	names := []string{}
+	for name := range entity.Identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var ret *packet.Signature
+	for _, name := range names {
+		sig := entity.Identities[name].SelfSignature
+		if sig == nil {
+			continue
+		}
+		if ret == nil || isPrimaryId(sig) && !isPrimaryId(ret) {
+			ret = sig
+			continue
+		}
+		if isPrimaryId(sig) == isPrimaryId(ret) && sig.CreationTime.After(ret.CreationTime) {
+			ret = sig
+		}
+	}
+	return ret
+}
+
+// Check if the self-signature sig flags its identity as the primary one.
+func isPrimaryId(sig *packet.Signature) bool {
+	return sig.IsPrimaryId != nil && *sig.IsPrimaryId
+}
@@ -0,0 +1,275 @@
+package archive
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// Test Helpers {{{
+
+// When the keys made by newExpiringTestKey were created.
+var testKeyCreated = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Create a new OpenPGP key, created at testKeyCreated, which expires after
+// lifetime.
+func newExpiringTestKey(t testing.TB, lifetime time.Duration) *openpgp.Entity {
+	t.Helper()
+	config := &packet.Config{
+		RSABits: 1024,
+		Time:    func() time.Time { return testKeyCreated },
+	}
+	key, err := openpgp.NewEntity("Expiring Key", "", "expiring@example.com", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secs := uint32(lifetime / time.Second)
+	for name, identity := range key.Identities {
+		identity.SelfSignature.KeyLifetimeSecs = &secs
+		if err := identity.SelfSignature.SignUserId(name, key.PrimaryKey, key.PrivateKey, config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return key
+}
+
+// Make a detached signature over data with key, at the time when, which
+// expires after lifetime (if it's not 0).
+func signTestData(t testing.TB, key *openpgp.Entity, when time.Time, lifetime time.Duration, data []byte) []byte {
+	t.Helper()
+	a := Archive{
+		signers:           []Signer{entitySigner{entity: key}},
+		Clock:             func() time.Time { return when },
+		SignatureLifetime: lifetime,
+	}
+	sig := bytes.Buffer{}
+	if err := a.sign(&sig, packet.SigTypeBinary, data); err != nil {
+		t.Fatal(err)
+	}
+	return sig.Bytes()
+}
+
+// Get ReleaseOptions which check signatures as of when.
+func releaseOptionsAt(when time.Time) ReleaseOptions {
+	return ReleaseOptions{Clock: func() time.Time { return when }}
+}
+
+// }}}
+
+// Key Expiry {{{
+
+func TestCheckSignatureExpiredKey(t *testing.T) {
+	key := newExpiringTestKey(t, 24*time.Hour)
+	keyring := openpgp.EntityList{key}
+	data := []byte("Suite: unstable\n")
+	now := testKeyCreated.Add(48 * time.Hour)
+
+	beforeExpiry := signTestData(t, key, testKeyCreated.Add(time.Hour), 0, data)
+	afterExpiry := signTestData(t, key, testKeyCreated.Add(30*time.Hour), 0, data)
+
+	for _, test := range []struct {
+		name     string
+		sig      []byte
+		reject   bool
+		allow    bool
+		accepted bool
+	}{
+		{"default", beforeExpiry, false, false, true},
+		{"default, signed after expiry", afterExpiry, false, false, true},
+		{"rejected", beforeExpiry, true, false, false},
+		{"allowed", beforeExpiry, false, true, true},
+		{"allowed, signed after expiry", afterExpiry, false, true, false},
+		{"rejected and allowed", beforeExpiry, true, true, true},
+		{"rejected and allowed, signed after expiry", afterExpiry, true, true, false},
+	} {
+		options := releaseOptionsAt(now)
+		options.RejectExpiredKeys = test.reject
+		options.AllowExpiredKeys = test.allow
+
+		_, err := checkSignature(data, test.sig, keyring, options)
+		if test.accepted && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if !test.accepted && err == nil {
+			t.Errorf("%s: signature by an expired key was accepted", test.name)
+		}
+	}
+}
+
+func TestKeyExpiryPrimaryIdentity(t *testing.T) {
+	key := newExpiringTestKey(t, 24*time.Hour)
+
+	// A newer identity which isn't the primary one, and says the key never
+	// expires, must not be used, no matter the order of the Identities map.
+	isPrimary := false
+	never := uint32(0)
+	key.Identities["Other Key <other@example.com>"] = &openpgp.Identity{
+		Name:   "Other Key <other@example.com>",
+		UserId: packet.NewUserId("Other Key", "", "other@example.com"),
+		SelfSignature: &packet.Signature{
+			CreationTime:    testKeyCreated.Add(time.Hour),
+			IsPrimaryId:     &isPrimary,
+			KeyLifetimeSecs: &never,
+		},
+	}
+
+	for i := 0; i < 20; i++ {
+		expiry, ok := keyExpiry(key, key.PrimaryKey.KeyId)
+		if !ok || !expiry.Equal(testKeyCreated.Add(24*time.Hour)) {
+			t.Fatalf("Key expires at %s (%t), not a day after it was created", expiry, ok)
+		}
+	}
+}
+
+// }}}
+
+// Signature Expiry {{{
+
+func TestCheckSignatureExpired(t *testing.T) {
+	key := newTestKey(t)
+	keyring := openpgp.EntityList{key}
+	data := []byte("Suite: unstable\n")
+	signed := time.Date(2024, time.January, 2, 3, 4, 5, 0, time.UTC)
+	sig := signTestData(t, key, signed, time.Hour, data)
+
+	if _, err := checkSignature(data, sig, keyring, releaseOptionsAt(signed.Add(30*time.Minute))); err != nil {
+		t.Errorf("Signature was rejected before it expired: %s", err)
+	}
+	if _, err := checkSignature(data, sig, keyring, releaseOptionsAt(signed.Add(2*time.Hour))); err == nil {
+		t.Errorf("Signature was accepted after it expired")
+	}
+}
+
+func TestSignatureLifetimeRoundsUp(t *testing.T) {
+	key := newTestKey(t)
+	sig := signTestData(t, key, time.Now(), 500*time.Millisecond, []byte("Suite: unstable\n"))
+
+	p, err := packet.Read(bytes.NewReader(sig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, ok := p.(*packet.Signature)
+	if !ok {
+		t.Fatalf("Read a %T, not a signature", p)
+	}
+	if signature.SigLifetimeSecs == nil || *signature.SigLifetimeSecs != 1 {
+		t.Errorf("Signature lifetime is not rounded up to a second")
+	}
+}
+
+// }}}
+
+// Signing Keys {{{
+
+func TestNewWithSignersPublicKey(t *testing.T) {
+	public := *newExpiringTestKey(t, 0)
+	public.PrivateKey = nil
+	if _, err := NewWithSigners(t.TempDir(), []*openpgp.Entity{&public}); err == nil {
+		t.Fatalf("An Archive was created with a signing key that has no Private Key")
+	}
+}
+
+func TestSigningSubkeyArchiveClock(t *testing.T) {
+	key := newExpiringTestKey(t, 0)
+	subkey := &key.Subkeys[0]
+	subkey.Sig.FlagSign = true
+	lifetime := uint32((24 * time.Hour) / time.Second)
+	subkey.Sig.KeyLifetimeSecs = &lifetime
+
+	for _, test := range []struct {
+		when time.Time
+		want uint64
+	}{
+		{testKeyCreated.Add(time.Hour), subkey.PublicKey.KeyId},
+		{testKeyCreated.Add(48 * time.Hour), key.PrimaryKey.KeyId},
+	} {
+		a := Archive{
+			signers: []Signer{entitySigner{entity: key}},
+			Clock:   func() time.Time { return test.when },
+		}
+		ids, err := a.SigningKeyIds()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != 1 || ids[0] != test.want {
+			t.Errorf("At %s, the signing key ids are %x, not %x", test.when, ids, test.want)
+		}
+	}
+}
+
+// }}}
+
+// Multiple Signers {{{
+
+func TestSignMultipleKeys(t *testing.T) {
+	keys := []*openpgp.Entity{newExpiringTestKey(t, 0), newExpiringTestKey(t, 0)}
+	when := testKeyCreated.Add(time.Hour)
+	a := Archive{
+		signers: []Signer{entitySigner{entity: keys[0]}, entitySigner{entity: keys[1]}},
+		Clock:   func() time.Time { return when },
+	}
+	data := []byte("Suite: unstable\nCodename: sid\n")
+
+	inRelease := bytes.Buffer{}
+	if err := a.clearsign(&inRelease, data); err != nil {
+		t.Fatal(err)
+	}
+	releaseGPG := bytes.Buffer{}
+	armored, err := armor.Encode(&releaseGPG, openpgp.SignatureType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.sign(armored, packet.SigTypeBinary, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := armored.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Clients which only trust one of the keys must accept both files.
+	for i, key := range keys {
+		keyring := openpgp.EntityList{key}
+		plaintext, signer, err := checkClearsigned(inRelease.Bytes(), keyring, releaseOptionsAt(when))
+		if err != nil {
+			t.Errorf("InRelease is not accepted with only key %d: %s", i, err)
+		} else if signer != key {
+			t.Errorf("InRelease is not signed by key %d", i)
+		} else if strings.TrimSpace(string(plaintext)) != strings.TrimSpace(string(data)) {
+			t.Errorf("InRelease signs %q, not %q", plaintext, data)
+		}
+
+		signer, err = checkArmoredDetached(data, bytes.NewReader(releaseGPG.Bytes()), keyring, releaseOptionsAt(when))
+		if err != nil {
+			t.Errorf("Release.gpg is not accepted with only key %d: %s", i, err)
+		} else if signer != key {
+			t.Errorf("Release.gpg is not signed by key %d", i)
+		}
+	}
+}
+
+// }}}
+
+// LoadRelease {{{
+
+func TestLoadReleaseWithoutKeyring(t *testing.T) {
+	release, err := LoadReleaseWithOptions(
+		strings.NewReader("Suite: unstable\nCodename: sid\n"),
+		strings.NewReader("not a signature"),
+		nil,
+		ReleaseOptions{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if release.Suite != "unstable" {
+		t.Errorf("Suite is %q, not unstable", release.Suite)
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -21,19 +21,23 @@
 package archive
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"iter"
 	"os"
+	"path"
 	"strconv"
-
-	"crypto/md5"
-	"crypto/sha1"
-	"crypto/sha256"
-	"hash"
+	"strings"
 
 	"pault.ag/go/debian/control"
 	"pault.ag/go/debian/deb"
 	"pault.ag/go/debian/dependency"
+	"pault.ag/go/debian/hashio"
 	"pault.ag/go/debian/version"
 )
 
@@ -52,13 +56,18 @@ type Package struct {
 	Priority      string
 	Architecture  dependency.Arch `required:"true"`
 	Essential     string
-	InstalledSize int    `control:"Installed-Size"`
+	InstalledSize int    `control:"Installed-Size"` // in KiB, see InstalledSizeBytes
 	Maintainer    string `required:"true"`
 	Description   string `required:"true"`
 	Homepage      string
 
+	// Percentage of machines which should get this update, used for staged
+	// rollouts. This is nil if the field is not set, which is distinct from
+	// a value of 0.
+	PhasedUpdatePercentage *int `control:"Phased-Update-Percentage"`
+
 	Filename       string `required:"true"`
-	Size           int    `required:"true"`
+	Size           int64  `required:"true"`
 	MD5sum         string
 	SHA1           string
 	SHA256         string
@@ -70,51 +79,302 @@ type Package struct {
 	BuiltUsing dependency.Dependency `control:"Built-Using"`
 	Breaks     dependency.Dependency
 	PreDepends dependency.Dependency `control:"Pre-Depends"`
+
+	// Component this Package was loaded from, if known. This is not read
+	// from (or written to) the Packages file, see LoadComponentPackages.
+	Component string `control:"-"`
+}
+
+// Package Helpers {{{
+
+// Check to see if this Package is being rolled out in phases, which is to
+// say, it has a Phased-Update-Percentage set that is below 100.
+func (p Package) IsPhased() bool {
+	return p.PhasedUpdatePercentage != nil && *p.PhasedUpdatePercentage < 100
+}
+
+// Get the InstalledSize of the Package in bytes, rather than KiB, so it can
+// be added up with Size.
+func (p Package) InstalledSizeBytes() int64 {
+	return int64(p.InstalledSize) * 1024
+}
+
+// Check to see if two Package entries are the same, ignoring the order of
+// fields and any cosmetic whitespace. Fields that exist only in the
+// underlying Paragraph are compared as well.
+func (p Package) Equal(other Package) bool {
+	return canonicalEqual(p.Paragraph, &p, other.Paragraph, &other)
 }
 
+// Get the FileHash of the .deb this Package refers to, relative to the root
+// of the archive, suitable for fetching and verifying it from the pool.
+func (p Package) poolFileHash() control.FileHash {
+	return control.FileHash{
+		Algorithm: "sha256",
+		Hash:      p.SHA256,
+		Size:      p.Size,
+		Filename:  p.Filename,
+	}
+}
+
+// Check to see if two control structs are the same once canonicalized, see
+// canonicalParagraph.
+func canonicalEqual(aParagraph control.Paragraph, a interface{}, bParagraph control.Paragraph, b interface{}) bool {
+	aValues, err := canonicalParagraph(aParagraph, a)
+	if err != nil {
+		return false
+	}
+	bValues, err := canonicalParagraph(bParagraph, b)
+	if err != nil {
+		return false
+	}
+	if len(aValues) != len(bValues) {
+		return false
+	}
+	for key, value := range aValues {
+		if bValues[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Get a canonical form of a control struct for comparison. This contains
+// every value of the underlying Paragraph, overlaid with the typed fields of
+// the struct, with whitespace stripped from the ends of each line. Empty
+// values are dropped, so an empty field and a missing field are the same.
+func canonicalParagraph(paragraph control.Paragraph, data interface{}) (map[string]string, error) {
+	typed, err := control.ConvertToParagraph(data)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := map[string]string{}
+	for _, values := range []map[string]string{paragraph.Values, typed.Values} {
+		for key, value := range values {
+			lines := strings.Split(strings.TrimSpace(value), "\n")
+			for i, line := range lines {
+				lines[i] = strings.TrimSpace(line)
+			}
+			value = strings.Join(lines, "\n")
+			if value == "" {
+				delete(ret, key)
+				continue
+			}
+			ret[key] = value
+		}
+	}
+	return ret, nil
+}
+
+// }}}
+
 // PackageFromDeb {{{
 
 // Create a Package entry from a deb.Deb file. This will copy the binary
 // .deb Control file into the Package entry, and set information as to
 // the location of the file, the size of the file, and hash the file.
 func PackageFromDeb(debFile deb.Deb) (*Package, error) {
+	return PackageFromDebWithOptions(debFile, PackageFromDebOptions{})
+}
+
+// Options to control how PackageFromDebWithOptions creates a Package entry.
+type PackageFromDebOptions struct {
+	// If set, and the .deb Control file has no Installed-Size, compute it
+	// from the data.tar of the .deb. This reopens the .deb (so debFile.Data
+	// is left unread) and reads the whole data.tar, so it's not done unless
+	// asked for.
+	ComputeInstalledSize bool
+
+	// Hash algorithms to compute for the .deb ("md5", "sha1", "sha256" or
+	// "sha512"). If empty, all of them are computed. The SHA256 is always
+	// computed, since it's what the .deb is verified against when fetched.
+	Hashes []string
+}
+
+// Map of the hash algorithms PackageFromDebWithOptions can compute to the
+// Packages field each one is stored in.
+var packageHashFields = map[string]string{
+	"md5":    "MD5sum",
+	"sha1":   "SHA1",
+	"sha256": "SHA256",
+	"sha512": "SHA512",
+}
+
+// Get the hash algorithms PackageFromDebWithOptions should compute.
+func (options PackageFromDebOptions) hashes() ([]string, error) {
+	if len(options.Hashes) == 0 {
+		return []string{"md5", "sha1", "sha256", "sha512"}, nil
+	}
+	ret := []string{"sha256"}
+	for _, algo := range options.Hashes {
+		algo = normalizeHashName(algo)
+		if _, ok := packageHashFields[algo]; !ok {
+			return nil, fmt.Errorf("Unsupported Package hash: %s", algo)
+		}
+		if algo != "sha256" {
+			ret = append(ret, algo)
+		}
+	}
+	return ret, nil
+}
+
+// Like PackageFromDeb, but with PackageFromDebOptions to control how the
+// Package entry is created.
+func PackageFromDebWithOptions(debFile deb.Deb, options PackageFromDebOptions) (*Package, error) {
 	pkg := Package{}
 
-	paragraph := debFile.Control.Paragraph
+	// The Values and Order of a Paragraph are shared by every copy of it, so
+	// they're copied here, to leave the Control of debFile as it was.
+	paragraph := control.Paragraph{
+		Values: map[string]string{},
+		Order:  append([]string{}, debFile.Control.Paragraph.Order...),
+	}
+	for key, value := range debFile.Control.Paragraph.Values {
+		paragraph.Values[key] = value
+	}
 	paragraph.Set("Filename", debFile.Path)
+
+	if options.ComputeInstalledSize && paragraph.Values["Installed-Size"] == "" {
+		installedSize, err := computeInstalledSize(debFile.Path)
+		if err != nil {
+			return nil, err
+		}
+		paragraph.Set("Installed-Size", strconv.FormatInt(installedSize, 10))
+	}
 	/* Now, let's do some magic */
 
 	fd, err := os.Open(debFile.Path)
 	if err != nil {
 		return nil, err
 	}
+	defer fd.Close()
 	stat, err := fd.Stat()
 	if err != nil {
 		return nil, err
 	}
 
-	paragraph.Set("Size", strconv.Itoa(int(stat.Size())))
+	paragraph.Set("Size", strconv.FormatInt(stat.Size(), 10))
 	/* Right, now, in addition, we ought to hash the crap out of the file */
 
-	md5sum := md5.New()
-	sha1 := sha1.New()
-	sha256 := sha256.New()
-
-	writer := io.MultiWriter(md5sum, sha256, sha1)
+	algos, err := options.hashes()
+	if err != nil {
+		return nil, err
+	}
+	writer, hashers, err := newHashers(algos)
+	if err != nil {
+		return nil, err
+	}
 
 	if _, err := io.Copy(writer, fd); err != nil {
 		return nil, err
 	}
 
-	for key, hasher := range map[string]hash.Hash{
-		"MD5sum": md5sum,
-		"SHA1":   sha1,
-		"SHA256": sha256,
-	} {
-		paragraph.Set(key, fmt.Sprintf("%x", hasher.Sum(nil)))
+	for _, hasher := range hashers {
+		paragraph.Set(packageHashFields[hasher.Name()], fmt.Sprintf("%x", hasher.Sum(nil)))
+	}
+
+	return &pkg, control.UnpackFromParagraph(paragraph, &pkg)
+}
+
+// Compute the Installed-Size of the .deb at debPath from its data.tar, in
+// KiB, the same way dpkg-gencontrol does: every regular file counts for its
+// size rounded up to the next KiB, and every other entry (directories,
+// symlinks, etc.) counts for 1 KiB.
+//
+// The .deb is opened anew, since the data.tar of a deb.Deb can only be read
+// once, and belongs to whoever loaded it.
+func computeInstalledSize(debPath string) (int64, error) {
+	debFile, closer, err := deb.LoadFile(debPath)
+	if err != nil {
+		return 0, err
+	}
+	defer closer()
+
+	var size int64
+	for {
+		hdr, err := debFile.Data.Next()
+		if err == io.EOF {
+			return size, nil
+		} else if err != nil {
+			return 0, err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			size += (hdr.Size + 1023) / 1024
+		} else {
+			size++
+		}
+	}
+}
+
+// }}}
+
+// Changelog and Copyright {{{
+
+// Download the .deb this Package refers to using rd (verifying it against
+// the SHA256 of this Package entry), and return the Debian changelog shipped
+// in it. The changelog is decompressed transparently.
+func (p Package) Changelog(rd *ReleaseDownloader) (io.ReadCloser, error) {
+	return p.docFile(rd, "changelog.Debian.gz", "changelog.gz")
+}
+
+// Download the .deb this Package refers to using rd (verifying it against
+// the SHA256 of this Package entry), and return the copyright file shipped
+// in it.
+func (p Package) Copyright(rd *ReleaseDownloader) (io.ReadCloser, error) {
+	return p.docFile(rd, "copyright")
+}
+
+// Download the .deb this Package refers to, and return the first of the given
+// file names that exists in the package's /usr/share/doc directory. Files
+// ending in .gz are decompressed.
+func (p Package) docFile(rd *ReleaseDownloader, names ...string) (io.ReadCloser, error) {
+	fh := p.poolFileHash()
+	f, err := rd.poolTempFile(fh, cacheKey(fh))
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	debFile, err := deb.Load(f, f.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	docDir := path.Join("usr/share/doc", p.Package)
+	found := map[string][]byte{}
+	for {
+		hdr, err := debFile.Data.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg || path.Dir(path.Clean(hdr.Name)) != docDir {
+			continue
+		}
+		data, err := ioutil.ReadAll(debFile.Data)
+		if err != nil {
+			return nil, err
+		}
+		found[path.Base(hdr.Name)] = data
 	}
 
-	return &pkg, control.UnpackFromParagraph(debFile.Control.Paragraph, &pkg)
+	// Files are only picked once the whole tarball has been read, since the
+	// order of names is a preference (a non-native package may well ship
+	// an upstream changelog.gz as well as its changelog.Debian.gz)
+	for _, name := range names {
+		data, ok := found[name]
+		if !ok {
+			continue
+		}
+		if path.Ext(name) == ".gz" {
+			return gzip.NewReader(bytes.NewReader(data))
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	return nil, fmt.Errorf("%s not found in %s", path.Join(docDir, names[0]), p.Filename)
 }
 
 // }}}
@@ -126,7 +386,59 @@ func PackageFromDeb(debFile deb.Deb) (*Package, error) {
 // Iterator to access the entries contained in the Packages entry in an
 // apt repo. This contians information about the binary Debian packages.
 type Packages struct {
-	decoder *control.Decoder
+	reader    *control.ParagraphReader
+	component string
+
+	// If set, a Package entry that can't be parsed will be skipped, rather
+	// than stopping the iteration with an error. The errors for any skipped
+	// entries can be fetched with Skipped, which should be checked to know if
+	// the Packages returned are complete.
+	SkipMalformed bool
+	skipped       []error
+
+	// If set, called once by Close, or once Next returns io.EOF, to release
+	// whatever the Packages list is read from.
+	closer func() error
+}
+
+// Release whatever the Packages list is being read from, such as the
+// temporary file of ReleaseDownloader.Packages. This is done automatically
+// once Next returns io.EOF, so it's only needed if the Packages list is not
+// read to the end. It's safe to call more than once.
+func (p *Packages) Close() error {
+	if p.closer == nil {
+		return nil
+	}
+	closer := p.closer
+	p.closer = nil
+	return closer()
+}
+
+// Get the errors for any Package entries which were skipped so far due to
+// SkipMalformed being set.
+func (p *Packages) Skipped() []error {
+	return p.skipped
+}
+
+// Get an iterator over the rest of the Package entries in the Packages
+// list, for use with range, as an alternative to calling Next until io.EOF.
+// If Next returns an error other than io.EOF, it's yielded (with a nil
+// Package) as the last value.
+func (p *Packages) All() iter.Seq2[*Package, error] {
+	return func(yield func(*Package, error) bool) {
+		for {
+			pkg, err := p.Next()
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(pkg, nil) {
+				return
+			}
+		}
+	}
 }
 
 // Map {{{
@@ -135,11 +447,7 @@ type Packages struct {
 func (p *Packages) Map(q func(*Package) bool) ([]Package, error) {
 	ret := []Package{}
 
-	for {
-		pkg, err := p.Next()
-		if err == io.EOF {
-			return ret, nil
-		}
+	for pkg, err := range p.All() {
 		if err != nil {
 			return nil, err
 		}
@@ -159,8 +467,30 @@ func (p *Packages) Map(q func(*Package) bool) ([]Package, error) {
 // Get the next Package entry in the Packages list. This will return an
 // io.EOF at the last entry.
 func (p *Packages) Next() (*Package, error) {
-	next := Package{}
-	return &next, p.decoder.Decode(&next)
+	for {
+		next := Package{}
+		paragraph, err := p.reader.Next()
+		if err == io.EOF {
+			if err := p.Close(); err != nil {
+				return &next, err
+			}
+		}
+		if err != nil {
+			return &next, err
+		}
+		if err := control.UnpackFromParagraph(*paragraph, &next); err != nil {
+			if p.SkipMalformed {
+				p.skipped = append(p.skipped, fmt.Errorf(
+					"Skipping malformed Package '%s': %v",
+					paragraph.Values["Package"], err,
+				))
+				continue
+			}
+			return &next, err
+		}
+		next.Component = p.component
+		return &next, nil
+	}
 }
 
 // }}}
@@ -170,12 +500,21 @@ func (p *Packages) Next() (*Package, error) {
 // Given a path, create a Packages iterator. Note that the Packages
 // file is not OpenPGP signed, so one will need to verify the integrety
 // of this file from the InRelease file before trusting any output.
+//
+// The file is closed once the iterator returns io.EOF, or is closed with
+// Packages.Close.
 func LoadPackagesFile(path string) (*Packages, error) {
 	fd, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
-	return LoadPackages(fd)
+	packages, err := LoadPackages(fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	packages.closer = fd.Close
+	return packages, nil
 }
 
 // }}}
@@ -185,16 +524,108 @@ func LoadPackagesFile(path string) (*Packages, error) {
 // Given an io.Reader, create a Packages iterator. Note that the Packages
 // file is not OpenPGP signed, so one will need to verify the integrety
 // of this file from the InRelease file before trusting any output.
+//
+// Continuation lines indented with a tab rather than a space (as written by
+// some third-party tools, and by hand) are accepted, and treated as if they
+// were indented with a single space.
+//
+// in is never closed by the iterator, even if it's an io.Closer; that's up to
+// the caller.
 func LoadPackages(in io.Reader) (*Packages, error) {
-	decoder, err := control.NewDecoder(in, nil)
+	reader, err := control.NewParagraphReader(&continuationReader{
+		in: bufio.NewReader(in),
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Packages{reader: reader}, nil
+}
+
+// io.Reader which replaces a tab at the start of a line with a single space,
+// so that tab-indented continuation lines read the same as the space-indented
+// ones apt writes. A line starting with a tab can only ever be a
+// continuation line, so nothing else is changed.
+type continuationReader struct {
+	in      *bufio.Reader
+	pending []byte
+	err     error
+}
+
+func (c *continuationReader) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		c.pending, c.err = c.in.ReadBytes('\n')
+		if len(c.pending) > 0 && c.pending[0] == '\t' {
+			c.pending[0] = ' '
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// }}}
+
+// LoadComponentPackages {{{
+
+// Like LoadPackages, but every Package returned will have its Component set
+// to the given component, so that it's possible to tell where a Package came
+// from once Packages from many Components are merged together.
+func LoadComponentPackages(in io.Reader, component string) (*Packages, error) {
+	packages, err := LoadPackages(in)
 	if err != nil {
 		return nil, err
 	}
-	return &Packages{decoder: decoder}, nil
+	packages.component = component
+	return packages, nil
 }
 
 // }}}
 
 // }}}
 
+// PackagesEncoder {{{
+
+// Encoder to write out a Packages index to any io.Writer, hashing it as it
+// goes, without needing an Archive. This is useful for writing a Packages
+// file to stdout or a pipe, outside of any blobstore.
+type PackagesEncoder struct {
+	encoder *control.Encoder
+	hashers []*hashio.Hasher
+}
+
+// Create a new PackagesEncoder writing to the given io.Writer, and hashing
+// the output with each of the given hash algorithms (such as "sha256").
+func NewPackagesEncoder(w io.Writer, algos []string) (*PackagesEncoder, error) {
+	hashWriter, hashers, err := newHashers(algos)
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := control.NewEncoder(io.MultiWriter(w, hashWriter))
+	if err != nil {
+		return nil, err
+	}
+	return &PackagesEncoder{encoder: encoder, hashers: hashers}, nil
+}
+
+// Write a Package entry into the Packages index.
+func (p *PackagesEncoder) Add(pkg Package) error {
+	return p.encoder.Encode(pkg)
+}
+
+// Finish the Packages index, and return the FileHash of everything written,
+// one for each of the hash algorithms. The Filename of each is left empty,
+// since the PackagesEncoder has no idea where the data is going.
+func (p *PackagesEncoder) Close() ([]control.FileHash, error) {
+	ret := []control.FileHash{}
+	for _, hasher := range p.hashers {
+		ret = append(ret, control.FileHashFromHasher("", *hasher))
+	}
+	return ret, nil
+}
+
+// }}}
+
 // vim: foldmethod=marker
@@ -0,0 +1,345 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"pault.ag/go/debian/deb"
+)
+
+// Test Helpers {{{
+
+// A file to put into the data.tar of a .deb built by writeTestDeb; a Size
+// of -1 is a directory.
+type testDebFile struct {
+	Name string
+	Size int64
+}
+
+// Build a gzip compressed tarball holding the given entries.
+func testTarball(t testing.TB, write func(*tar.Writer) error) []byte {
+	t.Helper()
+	buf := bytes.Buffer{}
+	compressor := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(compressor)
+	if err := write(tw); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := compressor.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Write a .deb into dir, with the given control file and data.tar entries,
+// and return its path.
+func writeTestDeb(t testing.TB, dir, name, controlFile string, files []testDebFile) string {
+	t.Helper()
+
+	controlTar := testTarball(t, func(tw *tar.Writer) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Name: "./control",
+			Mode: 0644,
+			Size: int64(len(controlFile)),
+		}); err != nil {
+			return err
+		}
+		_, err := io.WriteString(tw, controlFile)
+		return err
+	})
+	dataTar := testTarball(t, func(tw *tar.Writer) error {
+		for _, file := range files {
+			if file.Size < 0 {
+				if err := tw.WriteHeader(&tar.Header{
+					Name:     file.Name,
+					Mode:     0755,
+					Typeflag: tar.TypeDir,
+				}); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := tw.WriteHeader(&tar.Header{
+				Name: file.Name,
+				Mode: 0644,
+				Size: file.Size,
+			}); err != nil {
+				return err
+			}
+			if _, err := tw.Write(make([]byte, file.Size)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	buf := bytes.Buffer{}
+	buf.WriteString("!<arch>\n")
+	for _, member := range []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", controlTar},
+		{"data.tar.gz", dataTar},
+	} {
+		fmt.Fprintf(&buf, "%-16s%-12d%-6d%-6d%-8s%-10d`\n",
+			member.name, 0, 0, 0, "100644", len(member.data))
+		buf.Write(member.data)
+		if len(member.data)%2 == 1 {
+			buf.WriteByte('\n')
+		}
+	}
+
+	debPath := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(debPath, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return debPath
+}
+
+// Load the .deb at debPath, closing it when the test is done.
+func loadTestDeb(t testing.TB, debPath string) *deb.Deb {
+	t.Helper()
+	debFile, closer, err := deb.LoadFile(debPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closer() })
+	return debFile
+}
+
+const testDebControl = `Package: hello
+Version: 1.0-1
+Architecture: amd64
+Maintainer: Test Maintainer <maintainer@example.com>
+Description: Test package hello
+`
+
+// Encode pkg into a Packages index, and load it back out again.
+func roundTripPackage(t testing.TB, pkg Package) Package {
+	t.Helper()
+	encoded, err := encodeBytes(pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packages, err := LoadPackages(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret, err := packages.Next()
+	if err != nil {
+		t.Fatalf("%s, reading:\n%s", err, encoded)
+	}
+	return *ret
+}
+
+// }}}
+
+// PackageFromDeb {{{
+
+// Files in the data.tar of the test .deb, which are 1 + 2 + 0 + 1 KiB.
+var testDebFiles = []testDebFile{
+	{Name: "./usr/", Size: -1},
+	{Name: "./usr/hello", Size: 1500},
+	{Name: "./usr/empty", Size: 0},
+	{Name: "./usr/small", Size: 10},
+}
+
+// Check that the data.tar of debFile can still be read in full.
+func checkDebDataUnread(t *testing.T, debFile *deb.Deb) {
+	t.Helper()
+	entries := 0
+	for {
+		_, err := debFile.Data.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		entries++
+	}
+	if entries != len(testDebFiles) {
+		t.Errorf("Only %d of the %d data.tar entries were left", entries, len(testDebFiles))
+	}
+}
+
+func TestPackageFromDeb(t *testing.T) {
+	debPath := writeTestDeb(t, t.TempDir(), "hello_1.0-1_amd64.deb", testDebControl, testDebFiles)
+	debFile := loadTestDeb(t, debPath)
+	data, err := ioutil.ReadFile(debPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+
+	pkg, err := PackageFromDeb(*debFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Package != "hello" {
+		t.Errorf("Package is %q, not hello", pkg.Package)
+	}
+	if pkg.Filename != debPath {
+		t.Errorf("Filename is %q, not %q", pkg.Filename, debPath)
+	}
+	if pkg.Size != int64(len(data)) {
+		t.Errorf("Size is %d, not %d", pkg.Size, len(data))
+	}
+	if pkg.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("SHA256 is %q, not %x", pkg.SHA256, sum)
+	}
+}
+
+func TestPackageFromDebComputeInstalledSize(t *testing.T) {
+	debPath := writeTestDeb(t, t.TempDir(), "hello_1.0-1_amd64.deb", testDebControl, testDebFiles)
+	debFile := loadTestDeb(t, debPath)
+
+	pkg, err := PackageFromDebWithOptions(*debFile, PackageFromDebOptions{
+		ComputeInstalledSize: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.InstalledSize != 4 {
+		t.Errorf("Installed-Size is %d, not 4", pkg.InstalledSize)
+	}
+	checkDebDataUnread(t, debFile)
+}
+
+func TestPackageFromDebKeepInstalledSize(t *testing.T) {
+	debPath := writeTestDeb(t, t.TempDir(), "hello_1.0-1_amd64.deb",
+		testDebControl+"Installed-Size: 42\n", testDebFiles)
+	debFile := loadTestDeb(t, debPath)
+
+	pkg, err := PackageFromDebWithOptions(*debFile, PackageFromDebOptions{
+		ComputeInstalledSize: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.InstalledSize != 42 {
+		t.Errorf("Installed-Size is %d, not the 42 from the control file", pkg.InstalledSize)
+	}
+	checkDebDataUnread(t, debFile)
+}
+
+func TestPackageFromDebLeavesControl(t *testing.T) {
+	debPath := writeTestDeb(t, t.TempDir(), "hello_1.0-1_amd64.deb", testDebControl, testDebFiles)
+	debFile := loadTestDeb(t, debPath)
+	order := len(debFile.Control.Paragraph.Order)
+
+	if _, err := PackageFromDeb(*debFile); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"Filename", "Size", "SHA256"} {
+		if _, ok := debFile.Control.Paragraph.Values[key]; ok {
+			t.Errorf("%s was set on the Control of the .deb", key)
+		}
+	}
+	if len(debFile.Control.Paragraph.Order) != order {
+		t.Errorf("Fields were added to the Order of the Control of the .deb")
+	}
+}
+
+// }}}
+
+// Fields {{{
+
+func TestPackagePhasedUpdatePercentage(t *testing.T) {
+	pkg := newTestPackage(t, "hello", "1.0-1", "amd64")
+	if got := roundTripPackage(t, pkg); got.PhasedUpdatePercentage != nil || got.IsPhased() {
+		t.Errorf("Phased-Update-Percentage appeared out of nowhere")
+	}
+
+	for _, percentage := range []int{0, 30, 100} {
+		percentage := percentage
+		pkg.PhasedUpdatePercentage = &percentage
+		got := roundTripPackage(t, pkg)
+		if got.PhasedUpdatePercentage == nil {
+			t.Errorf("Phased-Update-Percentage %d was lost", percentage)
+			continue
+		}
+		if *got.PhasedUpdatePercentage != percentage {
+			t.Errorf("Phased-Update-Percentage %d came back as %d", percentage, *got.PhasedUpdatePercentage)
+		}
+		if got.IsPhased() != (percentage < 100) {
+			t.Errorf("Phased-Update-Percentage %d is phased: %t", percentage, got.IsPhased())
+		}
+	}
+}
+
+func TestPackageLargeSize(t *testing.T) {
+	pkg := newTestPackage(t, "hello-data", "1.0-1", "all")
+	pkg.Size = 1<<32 + 12345
+	if got := roundTripPackage(t, pkg); got.Size != pkg.Size {
+		t.Errorf("Size %d came back as %d", pkg.Size, got.Size)
+	}
+}
+
+// LoadPackages {{{
+
+// Build a Packages file with a single hello Package, whose long Description
+// has continuation lines indented by indent.
+func testPackagesFile(indent string) string {
+	lines := []string{
+		"Package: hello",
+		"Version: 1.0-1",
+		"Architecture: amd64",
+		"Filename: pool/main/h/hello/hello_1.0-1_amd64.deb",
+		"Size: 1234",
+		"Description: example package",
+	}
+	for i := 0; i < 200; i++ {
+		lines = append(lines, fmt.Sprintf("%sLine %d of the long description.", indent, i))
+	}
+	lines = append(lines,
+		indent+".",
+		indent+strings.Repeat("A line longer than any read buffer. ", 300),
+	)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestLoadPackagesTabContinuation(t *testing.T) {
+	descriptions := map[string]string{}
+	for name, indent := range map[string]string{"space": " ", "tab": "\t"} {
+		packages, err := LoadPackages(strings.NewReader(testPackagesFile(indent)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkg, err := packages.Next()
+		if err != nil {
+			t.Fatalf("%s indented: %s", name, err)
+		}
+		if pkg.Package != "hello" {
+			t.Errorf("%s indented: read Package %q", name, pkg.Package)
+		}
+		if !strings.Contains(pkg.Description, "Line 199 of the long description.") ||
+			!strings.Contains(pkg.Description, "A line longer than any read buffer.") {
+			t.Errorf("%s indented: the Description was cut short: %q", name, pkg.Description)
+		}
+		if _, err := packages.Next(); err != io.EOF {
+			t.Errorf("%s indented: read more than one Package: %v", name, err)
+		}
+		descriptions[name] = pkg.Description
+	}
+	if descriptions["tab"] != descriptions["space"] {
+		t.Errorf("The tab indented Description reads differently")
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
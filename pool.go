@@ -5,6 +5,10 @@ import (
 	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 
 	"pault.ag/go/blobstore"
 	"pault.ag/go/debian/control"
@@ -13,10 +17,35 @@ import (
 
 type Pool struct {
 	Store blobstore.Store
+
+	// Parallel limits the number of files IncludeSources copies into the
+	// Store at the same time. The default value of 0 copies them one at a
+	// time.
+	Parallel int
+
+	// Component the files are included in, such as "main". If set, files
+	// are put in pool/<component>/<prefix>/<source> rather than
+	// pool/<prefix>/<source>. See Component.Pool.
+	Component string
+}
+
+// Get the root of this Pool, relative to the root of the archive.
+func (p Pool) root() string {
+	return path.Join("pool", p.Component)
 }
 
-func poolPrefix(source string) string {
-	return path.Join(source[0:1], source)
+// Get the directory of the pool that files of the given source package go
+// in, relative to the root of the pool. Like dak, this is the first letter
+// of the source package, or, for lib* packages, the first four, such as
+// "f/foo" or "libf/libfoo".
+func poolPrefix(source string) (string, error) {
+	if source == "" {
+		return "", fmt.Errorf("No source package name to put into the pool")
+	}
+	if strings.HasPrefix(source, "lib") && len(source) > 3 {
+		return path.Join(source[0:4], source), nil
+	}
+	return path.Join(source[0:1], source), nil
 }
 
 func (p Pool) Copy(path string) (*blobstore.Object, error) {
@@ -47,25 +76,64 @@ func (p Pool) Copy(path string) (*blobstore.Object, error) {
 func (p Pool) IncludeSources(dsc *control.DSC) (string, map[string]blobstore.Object, error) {
 	files := map[string]blobstore.Object{}
 
-	targetDir := path.Join("pool", poolPrefix(dsc.Source))
+	if err := checkSourceFormat(dsc); err != nil {
+		return "", nil, err
+	}
+
+	targetDir, err := p.sourcesPoolDir(dsc)
+	if err != nil {
+		return "", nil, err
+	}
 
+	filenames := []string{dsc.Filename}
 	for _, file := range dsc.Files {
-		obj, err := p.Copy(file.Filename)
-		if err != nil {
-			return "", nil, err
-		}
+		filenames = append(filenames, file.Filename)
+	}
 
-		localName := path.Base(file.Filename)
-		files[path.Join(targetDir, localName)] = *obj
+	parallel := p.Parallel
+	if parallel < 1 {
+		parallel = 1
 	}
+	workers := newPool(parallel)
 
-	obj, err := p.Copy(dsc.Filename)
-	if err != nil {
-		return "", nil, err
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for _, filename := range filenames {
+		filename := filename
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			workers.lock()
+			defer workers.unlock()
+
+			mu.Lock()
+			failed := firstErr != nil
+			mu.Unlock()
+			if failed {
+				return
+			}
+
+			obj, err := p.Copy(filename)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			files[path.Join(targetDir, path.Base(filename))] = *obj
+		}()
 	}
+	wg.Wait()
 
-	localName := path.Base(dsc.Filename)
-	files[path.Join(targetDir, localName)] = *obj
+	if firstErr != nil {
+		return "", nil, firstErr
+	}
 
 	for path, object := range files {
 		if err := p.Store.Link(object, path); err != nil {
@@ -76,22 +144,151 @@ func (p Pool) IncludeSources(dsc *control.DSC) (string, map[string]blobstore.Obj
 	return targetDir, files, nil
 }
 
+// Check that the files IncludeSources included from the given .dsc (as
+// returned by it) have the content the .dsc says they do, by reading each
+// back out of the Store, and checking it against the Checksums-Sha256 of the
+// .dsc (or, if it has none, its Files). Every file listed in the .dsc must
+// have been included.
+//
+// This is a post-condition check for publishing a source package, to catch
+// the content of the Store not being what was copied into it.
+func (p Pool) VerifyIncluded(dsc *control.DSC, files map[string]blobstore.Object) error {
+	fileHashes := []control.FileHash{}
+	for _, fileHash := range dsc.ChecksumsSha256 {
+		fileHashes = append(fileHashes, fileHash.FileHash)
+	}
+	if len(fileHashes) == 0 {
+		for _, fileHash := range dsc.Files {
+			fileHashes = append(fileHashes, fileHash.FileHash)
+		}
+	}
+
+	targetDir, err := p.sourcesPoolDir(dsc)
+	if err != nil {
+		return err
+	}
+	for _, fileHash := range fileHashes {
+		poolPath := path.Join(targetDir, path.Base(fileHash.Filename))
+		obj, ok := files[poolPath]
+		if !ok {
+			return fmt.Errorf("Pool file %s was not included", poolPath)
+		}
+		if err := p.verifyObject(obj, fileHash); err != nil {
+			return fmt.Errorf("Pool file %s does not match the .dsc: %v", poolPath, err)
+		}
+	}
+	return nil
+}
+
+// Read the Object back out of the Store, and check it against fileHash.
+func (p Pool) verifyObject(obj blobstore.Object, fileHash control.FileHash) error {
+	fd, err := p.Store.Open(obj)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	verifier, err := fileHash.Verifier()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(verifier, fd); err != nil {
+		return err
+	}
+	return verifier.Close()
+}
+
 func (p Pool) IncludeDeb(debFile *deb.Deb) (string, *blobstore.Object, error) {
+	debPath, err := p.debPoolPath(debFile)
+	if err != nil {
+		return "", nil, err
+	}
+
 	obj, err := p.Copy(debFile.Path)
 	if err != nil {
 		return "", nil, err
 	}
 
-	debPath := path.Join(
-		"pool",
-		poolPrefix(debFile.Control.SourceName()),
+	return debPath, obj, p.Store.Link(*obj, debPath)
+}
+
+// Get the directory in the pool that IncludeSources puts the files of the
+// given source package in.
+func (p Pool) sourcesPoolDir(dsc *control.DSC) (string, error) {
+	prefix, err := poolPrefix(dsc.Source)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(p.root(), prefix), nil
+}
+
+// Get the path in the pool that IncludeDeb puts the given .deb at.
+func (p Pool) debPoolPath(debFile *deb.Deb) (string, error) {
+	prefix, err := poolPrefix(debFile.Control.SourceName())
+	if err != nil {
+		return "", err
+	}
+	return path.Join(
+		p.root(),
+		prefix,
 		fmt.Sprintf(
 			"%s_%s_%s.deb",
 			debFile.Control.Package,
 			debFile.Control.Version,
 			debFile.Control.Architecture,
 		),
-	)
+	), nil
+}
 
-	return debPath, obj, p.Store.Link(*obj, debPath)
+// Get the list of paths in the pool that including the files of the given
+// .changes (with IncludeDeb and IncludeSources) would create, sorted, without
+// changing anything. The .debs and .dsc referenced by the .changes are read
+// to work out where they would go.
+//
+// This can be used to check an upload before it's included, such as to
+// reject one which would overwrite existing pool files with different
+// content. Files that the Pool does not include, such as .buildinfo files,
+// are not listed.
+func (p Pool) PlanUpload(chg *control.Changes) ([]string, error) {
+	paths := map[string]bool{}
+	dir := filepath.Dir(chg.Filename)
+
+	for _, file := range chg.Files {
+		filePath := filepath.Join(dir, file.Filename)
+		switch filepath.Ext(file.Filename) {
+		case ".deb", ".udeb":
+			debFile, closer, err := deb.LoadFile(filePath)
+			if err != nil {
+				return nil, err
+			}
+			debPath, pathErr := p.debPoolPath(debFile)
+			if err := closer(); err != nil {
+				return nil, err
+			}
+			if pathErr != nil {
+				return nil, pathErr
+			}
+			paths[debPath] = true
+		case ".dsc":
+			dsc, err := control.ParseDscFile(filePath)
+			if err != nil {
+				return nil, err
+			}
+			targetDir, err := p.sourcesPoolDir(dsc)
+			if err != nil {
+				return nil, err
+			}
+			for _, dscFile := range dsc.Files {
+				paths[path.Join(targetDir, path.Base(dscFile.Filename))] = true
+			}
+			paths[path.Join(targetDir, path.Base(dsc.Filename))] = true
+		}
+	}
+
+	ret := []string{}
+	for poolPath := range paths {
+		ret = append(ret, poolPath)
+	}
+	sort.Strings(ret)
+	return ret, nil
 }
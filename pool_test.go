@@ -0,0 +1,31 @@
+package archive
+
+import "testing"
+
+// Pool Paths {{{
+
+func TestPoolPrefix(t *testing.T) {
+	for source, prefix := range map[string]string{
+		"libfoo": "libf/libfoo",
+		"foo":    "f/foo",
+		"f":      "f/f",
+		"lib":    "l/lib",
+	} {
+		got, err := poolPrefix(source)
+		if err != nil {
+			t.Errorf("%s: %s", source, err)
+			continue
+		}
+		if got != prefix {
+			t.Errorf("%s is put in %s, not %s", source, got, prefix)
+		}
+	}
+
+	if prefix, err := poolPrefix(""); err == nil {
+		t.Errorf("An empty source name is put in %q", prefix)
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
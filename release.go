@@ -21,9 +21,17 @@
 package archive
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/openpgp"
 	"pault.ag/go/debian/control"
@@ -177,6 +185,16 @@ type Release struct {
 	ButAutomaticUpgrades string
 
 	AcquireByHash bool `control:"Acquire-By-Hash"`
+
+	// Index of the hash blocks by Filename, by Algorithm, kept by AddHash.
+	hashIndex map[string]*releaseHashIndex `control:"-"`
+}
+
+// Index of the FileHashes in one hash block of a Release by Filename, along
+// with how many entries of the hash block have been indexed.
+type releaseHashIndex struct {
+	indexed    int
+	byFilename map[string]control.FileHash
 }
 
 // Given a file declared in the Release file, get the FileHash entries
@@ -198,7 +216,268 @@ func (r *Release) Indices() map[string]control.FileHashes {
 	return ret
 }
 
+// Given a file declared in the Release file, get the size of that file as
+// declared in the Release, which is useful to check for completeness or to
+// estimate the size of a download before fetching anything.
+func (r *Release) IndexSizes() map[string]int64 {
+	ret := map[string]int64{}
+	for filename, hashes := range r.Indices() {
+		ret[filename] = hashes[0].Size
+	}
+	return ret
+}
+
+// Get a content identifier for the set of indices the Release describes,
+// which is the hex SHA256 over the sorted (filename, size, SHA256) of every
+// entry in the SHA256 block. Unlike a hash of the Release itself, this does
+// not depend on the Date, Valid-Until or signature, so two Releases of the
+// same indices have the same Fingerprint, whenever they were signed.
+func (r *Release) Fingerprint() string {
+	lines := []string{}
+	for _, fileHash := range r.SHA256 {
+		lines = append(lines, fmt.Sprintf(
+			"%s %d %s\n", fileHash.Filename, fileHash.Size, strings.ToLower(fileHash.Hash),
+		))
+	}
+	sort.Strings(lines)
+
+	hash := sha256.New()
+	for _, line := range lines {
+		hash.Write([]byte(line))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Fields which carry hash blocks we know about, and which are handled by the
+// typed fields of the Release.
+var releaseHashFields = map[string]bool{
+	"MD5Sum": true,
+	"SHA1":   true,
+	"SHA256": true,
+	"SHA512": true,
+}
+
+// Get any hash blocks that were read into the underlying Paragraph, but
+// which don't map onto a typed field of the Release (for instance, those for
+// an algorithm we don't know about yet). This is keyed by field name, and
+// contains the raw value of the field.
+func (r *Release) UnknownHashes() map[string]string {
+	ret := map[string]string{}
+	for key, value := range r.Paragraph.Values {
+		if releaseHashFields[key] || !isHashBlock(value) {
+			continue
+		}
+		ret[key] = value
+	}
+	return ret
+}
+
+// Check to see if a field value looks like a hash block, which is to say,
+// every line has a hex checksum, a size, and a filename.
+func isHashBlock(value string) bool {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return false
+	}
+	for _, line := range strings.Split(value, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return false
+		}
+		if _, err := hex.DecodeString(fields[0]); err != nil {
+			return false
+		}
+		if _, err := strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Encode the Release to the given io.Writer. This is the same as encoding
+// it with a control.Encoder, except that any hash blocks in the underlying
+// Paragraph that have no typed field (see UnknownHashes) are written out as
+// well, so loading and writing a Release doesn't drop data.
+func (r Release) Encode(out io.Writer) error {
+	paragraph, err := control.ConvertToParagraph(&r)
+	if err != nil {
+		return err
+	}
+	unknown := r.UnknownHashes()
+	for _, key := range r.Paragraph.Order {
+		if value, ok := unknown[key]; ok {
+			paragraph.Set(key, value)
+		}
+	}
+	return paragraph.WriteTo(out)
+}
+
+// Formats accepted for the Date and Valid-Until fields of a Release, in the
+// order they're tried. The first is what this package writes, and what
+// Debian and Ubuntu use ("Sat, 14 Oct 2023 08:51:37 UTC" is matched by the
+// second); the rest cover repositories which use a numeric zone with a zone
+// name, a single digit day, or no day of the week.
+var releaseTimeFormats = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 02 Jan 2006 15:04:05 -0700 (MST)",
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"02 Jan 2006 15:04:05 -0700",
+	"02 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 MST",
+}
+
+// Parse a date from a Release file, trying each of the releaseTimeFormats
+// in turn. Runs of whitespace are treated as a single space.
+func parseReleaseTime(value string) (time.Time, error) {
+	value = strings.Join(strings.Fields(value), " ")
+	for _, format := range releaseTimeFormats {
+		if when, err := time.Parse(format, value); err == nil {
+			return when, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Unknown date format: '%s'", value)
+}
+
+// Get the Date of the Release as a time.Time. See releaseTimeFormats for the
+// formats that are understood.
+func (r *Release) DateTime() (time.Time, error) {
+	return parseReleaseTime(r.Date)
+}
+
+// Get the Valid-Until of the Release as a time.Time, in the same formats as
+// DateTime. If the Release has no Valid-Until, the zero time.Time is
+// returned.
+func (r *Release) ValidUntilTime() (time.Time, error) {
+	if r.ValidUntil == "" {
+		return time.Time{}, nil
+	}
+	return parseReleaseTime(r.ValidUntil)
+}
+
+// Check if the Release is stale as of now, which is when its Valid-Until has
+// passed. A Release without a Valid-Until never expires. A Valid-Until that
+// can't be parsed is treated as expired, since there's no way to tell that
+// it isn't.
+func (r *Release) IsExpired(now time.Time) bool {
+	validUntil, err := r.ValidUntilTime()
+	if err != nil {
+		return true
+	}
+	return !validUntil.IsZero() && now.After(validUntil)
+}
+
+// Check that the Architectures and Components declared in the Release match
+// up with the indices listed in its hash blocks. Every Packages index must be
+// for a declared Component and Architecture (or "all"), and every declared
+// Component and Architecture must have at least one index. A Release that
+// fails this is broken, or has been tampered with.
+func (r *Release) Consistent() error {
+	components := map[string]bool{}
+	for _, component := range r.Components {
+		components[component] = false
+	}
+	arches := map[string]bool{}
+	for _, arch := range r.Architectures {
+		arches[arch.String()] = false
+	}
+
+	problems := []string{}
+	for filename := range r.Indices() {
+		dir, arch, ok := splitIndexPath(filename)
+		if !ok {
+			continue
+		}
+
+		// Indices may be in a directory beneath that of their Component,
+		// such as "main/debian-installer/binary-amd64/Packages", so the
+		// longest declared Component the directory is in is used.
+		component := ""
+		for declared := range components {
+			if dir != declared && !strings.HasPrefix(dir, declared+"/") {
+				continue
+			}
+			if len(declared) > len(component) {
+				component = declared
+			}
+		}
+		if component == "" {
+			problems = append(problems, fmt.Sprintf(
+				"'%s' is for undeclared Component '%s'", filename, dir))
+		} else {
+			components[component] = true
+		}
+
+		if arch == "" || arch == "all" {
+			continue
+		}
+		if _, ok := arches[arch]; !ok {
+			problems = append(problems, fmt.Sprintf(
+				"'%s' is for undeclared Architecture '%s'", filename, arch))
+		} else {
+			arches[arch] = true
+		}
+	}
+
+	for component, seen := range components {
+		if !seen {
+			problems = append(problems, fmt.Sprintf(
+				"Component '%s' has no indices", component))
+		}
+	}
+	for arch, seen := range arches {
+		if !seen {
+			problems = append(problems, fmt.Sprintf(
+				"Architecture '%s' has no indices", arch))
+		}
+	}
+
+	if len(problems) != 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("Release is not consistent: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// Split the path of an index listed in a Release into the directory holding
+// its "binary-<arch>" or "source" directory (such as "main", or
+// "main/debian-installer"), and the Architecture it's for, which is empty
+// for a Sources index. ok is false for any other file, such as a Contents or
+// Translation index.
+func splitIndexPath(filename string) (dir, arch string, ok bool) {
+	parts := strings.Split(filename, "/")
+	for i := 1; i < len(parts)-1; i++ {
+		if strings.HasPrefix(parts[i], "binary-") {
+			return strings.Join(parts[:i], "/"), strings.TrimPrefix(parts[i], "binary-"), true
+		}
+		if parts[i] == "source" {
+			return strings.Join(parts[:i], "/"), "", true
+		}
+	}
+	return "", "", false
+}
+
+// Add a FileHash to the hash block of the Release for its Algorithm.
+//
+// If the Release already has a FileHash for the same file and Algorithm,
+// this is a no-op if the two match, and an error if they don't, so the
+// Release never contradicts itself.
 func (r *Release) AddHash(h control.FileHash) error {
+	h.Algorithm = normalizeHashName(h.Algorithm)
+	index := r.indexHashes(h.Algorithm)
+	if existing, ok := index.byFilename[h.Filename]; ok {
+		if existing.Hash != h.Hash || existing.Size != h.Size {
+			return fmt.Errorf(
+				"Conflicting %s hashes for '%s': %s (%d) and %s (%d)",
+				h.Algorithm, h.Filename,
+				existing.Hash, existing.Size, h.Hash, h.Size,
+			)
+		}
+		return nil
+	}
+
 	switch h.Algorithm {
 	case "sha256":
 		r.SHA256 = append(r.SHA256, control.SHA256FileHash{h})
@@ -209,11 +488,238 @@ func (r *Release) AddHash(h control.FileHash) error {
 	case "md5":
 		r.MD5Sum = append(r.MD5Sum, control.MD5FileHash{h})
 	default:
-		return fmt.Errorf("No known hash: '%s'", h.Algorithm)
+		return fmt.Errorf("No known hash: '%s' (for '%s')", h.Algorithm, h.Filename)
 	}
+	index.byFilename[h.Filename] = h
+	index.indexed++
 	return nil
 }
 
+// Get the index of the hash block of the Release for the given (normalized)
+// algorithm, used by AddHash to find the FileHash of a file without going
+// over the whole hash block each time. Entries put into the hash block
+// directly, rather than by AddHash, are indexed here as well.
+func (r *Release) indexHashes(algorithm string) *releaseHashIndex {
+	if r.hashIndex == nil {
+		r.hashIndex = map[string]*releaseHashIndex{}
+	}
+	count := r.hashCount(algorithm)
+	index, ok := r.hashIndex[algorithm]
+	if !ok || index.indexed > count {
+		index = &releaseHashIndex{byFilename: map[string]control.FileHash{}}
+		r.hashIndex[algorithm] = index
+	}
+	if index.indexed < count {
+		for _, existing := range r.hashesFor(algorithm)[index.indexed:] {
+			if _, ok := index.byFilename[existing.Filename]; !ok {
+				index.byFilename[existing.Filename] = existing
+			}
+		}
+		index.indexed = count
+	}
+	return index
+}
+
+// Get the number of entries in the hash block of the Release for the given
+// algorithm.
+func (r *Release) hashCount(algorithm string) int {
+	switch normalizeHashName(algorithm) {
+	case "sha256":
+		return len(r.SHA256)
+	case "sha1":
+		return len(r.SHA1)
+	case "sha512":
+		return len(r.SHA512)
+	case "md5":
+		return len(r.MD5Sum)
+	}
+	return 0
+}
+
+// Get the canonical name of a hash algorithm, as used by hashio ("md5",
+// "sha1", "sha256" or "sha512"), from any of the common spellings of it, such
+// as "SHA256", "sha-256" or "MD5Sum". Names that aren't known are returned
+// lower-cased.
+func normalizeHashName(name string) string {
+	name = strings.ToLower(strings.Replace(name, "-", "", -1))
+	if name == "md5sum" {
+		return "md5"
+	}
+	return name
+}
+
+// Sort the entries of every hash block of the Release by Filename, so the
+// Release doesn't depend on the order the files were added in.
+func (r *Release) sortHashes() {
+	sort.Slice(r.MD5Sum, func(i, j int) bool { return r.MD5Sum[i].Filename < r.MD5Sum[j].Filename })
+	sort.Slice(r.SHA1, func(i, j int) bool { return r.SHA1[i].Filename < r.SHA1[j].Filename })
+	sort.Slice(r.SHA256, func(i, j int) bool { return r.SHA256[i].Filename < r.SHA256[j].Filename })
+	sort.Slice(r.SHA512, func(i, j int) bool { return r.SHA512[i].Filename < r.SHA512[j].Filename })
+}
+
+// Get the FileHashes in the hash block of the Release for the given
+// Algorithm.
+func (r *Release) hashesFor(algorithm string) []control.FileHash {
+	ret := []control.FileHash{}
+	switch normalizeHashName(algorithm) {
+	case "sha256":
+		for _, el := range r.SHA256 {
+			ret = append(ret, el.FileHash)
+		}
+	case "sha1":
+		for _, el := range r.SHA1 {
+			ret = append(ret, el.FileHash)
+		}
+	case "sha512":
+		for _, el := range r.SHA512 {
+			ret = append(ret, el.FileHash)
+		}
+	case "md5":
+		for _, el := range r.MD5Sum {
+			ret = append(ret, el.FileHash)
+		}
+	}
+	return ret
+}
+
+// }}}
+
+// ReleaseOptions {{{
+
+// Options to control how the signature (and the Date and Valid-Until) of a
+// Release is checked when it's loaded, see LoadInReleaseWithOptions and
+// LoadReleaseWithOptions.
+type ReleaseOptions struct {
+	// By default, a Release is accepted whether or not the key which signed
+	// it has since expired. If RejectExpiredKeys is set, a Release signed by
+	// a key which has expired is rejected.
+	RejectExpiredKeys bool
+
+	// If AllowExpiredKeys is set, a Release signed by a key which has
+	// expired is accepted as long as the key had not expired yet when the
+	// signature was made, like apt does, and rejected otherwise. This avoids
+	// spurious failures right after a key expires during a key transition.
+	// It takes precedence over RejectExpiredKeys.
+	AllowExpiredKeys bool
+
+	// Clock returns the current time, used to check for expiry. The default
+	// value of nil means time.Now is used.
+	Clock func() time.Time
+
+	// If set, the key which signed the Release must have one of these
+	// fingerprints (in hex, with or without spaces), in addition to being
+	// in the keyring. Either the fingerprint of the signing subkey or that
+	// of its primary key may be given.
+	PinnedFingerprints []string
+
+	// If set, a Release whose Valid-Until has passed is rejected with a
+	// *ReleaseExpiredError (which matches ErrReleaseExpired with errors.Is).
+	// This guards against a correctly signed, but stale, Release being
+	// replayed.
+	RejectExpired bool
+
+	// If set, a Release whose Date is more than MaxDateSkew ahead of the
+	// current time is rejected with ErrReleaseFromFuture.
+	MaxDateSkew time.Duration
+}
+
+var (
+	// Matched (with errors.Is) by the *ReleaseExpiredError returned when
+	// loading a Release with RejectExpired set, if the Valid-Until of the
+	// Release has passed.
+	ErrReleaseExpired = fmt.Errorf("Release has expired")
+
+	// Returned when loading a Release with MaxDateSkew set, if the Date of
+	// the Release is too far in the future.
+	ErrReleaseFromFuture = fmt.Errorf("Release is dated in the future")
+)
+
+// ReleaseExpiredError is returned when loading a Release with RejectExpired
+// set (or by Downloader.Release with RejectExpired set), if the Valid-Until
+// of the Release of Suite has passed.
+type ReleaseExpiredError struct {
+	Suite      string
+	ValidUntil string
+}
+
+func (e *ReleaseExpiredError) Error() string {
+	return fmt.Sprintf("Release(%s): expired at %s", e.Suite, e.ValidUntil)
+}
+
+// A ReleaseExpiredError is an ErrReleaseExpired.
+func (e *ReleaseExpiredError) Is(target error) bool {
+	return target == ErrReleaseExpired
+}
+
+// Get the current time, as given by Clock.
+func (o ReleaseOptions) now() time.Time {
+	if o.Clock != nil {
+		return o.Clock()
+	}
+	return time.Now()
+}
+
+// Parse a Release file, then check its Date and Valid-Until as set by the
+// options.
+func (o ReleaseOptions) decode(in io.Reader) (*Release, error) {
+	release, err := decodeRelease(in)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.RejectExpired && release.IsExpired(o.now()) {
+		return nil, &ReleaseExpiredError{Suite: release.Suite, ValidUntil: release.ValidUntil}
+	}
+
+	if o.MaxDateSkew > 0 {
+		date, err := release.DateTime()
+		if err != nil {
+			return nil, err
+		}
+		if date.Sub(o.now()) > o.MaxDateSkew {
+			return nil, ErrReleaseFromFuture
+		}
+	}
+
+	return release, nil
+}
+
+// }}}
+
+// ReleaseVerifier {{{
+
+// ReleaseVerifier checks the signature of release metadata, as loaded by
+// LoadInReleaseWithVerifier and LoadReleaseWithVerifier (and the Downloader).
+// OpenPGPVerifier is the one used by default, but another may be used for
+// repositories signed some other way, such as with minisign or raw Ed25519.
+type ReleaseVerifier interface {
+	// Check signed, the full contents of an InRelease file, returning the
+	// Release file signed by it.
+	VerifyInline(signed []byte) ([]byte, error)
+
+	// Check that sig (the contents of a Release.gpg file) is a valid
+	// signature over data (the contents of the Release file).
+	VerifyDetached(data, sig []byte) error
+}
+
+// ReleaseVerifier which checks OpenPGP signatures against Keyring, as
+// controlled by Options. InRelease files must be clearsigned, and Release.gpg
+// files ASCII armored.
+type OpenPGPVerifier struct {
+	Keyring openpgp.EntityList
+	Options ReleaseOptions
+}
+
+func (v OpenPGPVerifier) VerifyInline(signed []byte) ([]byte, error) {
+	plaintext, _, err := checkClearsigned(signed, v.Keyring, v.Options)
+	return plaintext, err
+}
+
+func (v OpenPGPVerifier) VerifyDetached(data, sig []byte) error {
+	_, err := checkArmoredDetached(data, bytes.NewReader(sig), v.Keyring, v.Options)
+	return err
+}
+
 // }}}
 
 // LoadInRelease {{{
@@ -221,8 +727,41 @@ func (r *Release) AddHash(h control.FileHash) error {
 // Given an InRelease io.Reader, and the OpenPGP keyring
 // to validate against, return the parsed InRelease file.
 func LoadInRelease(in io.Reader, keyring *openpgp.EntityList) (*Release, error) {
+	return LoadInReleaseWithOptions(in, keyring, ReleaseOptions{})
+}
+
+// Like LoadInRelease, but with ReleaseOptions to control how the signature,
+// Date and Valid-Until are checked.
+func LoadInReleaseWithOptions(in io.Reader, keyring *openpgp.EntityList, options ReleaseOptions) (*Release, error) {
+	if keyring == nil {
+		return options.decode(in)
+	}
+
+	return LoadInReleaseWithVerifier(in, OpenPGPVerifier{
+		Keyring: *keyring,
+		Options: options,
+	}, options)
+}
+
+// Like LoadInReleaseWithOptions, but the signature is checked by the given
+// ReleaseVerifier, rather than against an OpenPGP keyring. The options are
+// still used to check the Date and Valid-Until.
+func LoadInReleaseWithVerifier(in io.Reader, verifier ReleaseVerifier, options ReleaseOptions) (*Release, error) {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := verifier.VerifyInline(data)
+	if err != nil {
+		return nil, err
+	}
+	return options.decode(bytes.NewReader(plaintext))
+}
+
+// Parse a Release file, without checking any signature.
+func decodeRelease(in io.Reader) (*Release, error) {
 	ret := Release{}
-	decoder, err := control.NewDecoder(in, keyring)
+	decoder, err := control.NewDecoder(in, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -231,6 +770,48 @@ func LoadInRelease(in io.Reader, keyring *openpgp.EntityList) (*Release, error)
 
 // }}}
 
+// LoadRelease {{{
+
+// Given a Release io.Reader, the armored detached OpenPGP signature of it (as
+// found in the Release.gpg file), and the OpenPGP keyring to validate against,
+// return the parsed Release file.
+func LoadRelease(in io.Reader, sig io.Reader, keyring *openpgp.EntityList) (*Release, error) {
+	return LoadReleaseWithOptions(in, sig, keyring, ReleaseOptions{})
+}
+
+// Like LoadRelease, but with ReleaseOptions to control how the signature,
+// Date and Valid-Until are checked.
+func LoadReleaseWithOptions(in io.Reader, sig io.Reader, keyring *openpgp.EntityList, options ReleaseOptions) (*Release, error) {
+	if keyring == nil {
+		return options.decode(in)
+	}
+
+	return LoadReleaseWithVerifier(in, sig, OpenPGPVerifier{
+		Keyring: *keyring,
+		Options: options,
+	}, options)
+}
+
+// Like LoadReleaseWithOptions, but the signature is checked by the given
+// ReleaseVerifier, rather than against an OpenPGP keyring. The options are
+// still used to check the Date and Valid-Until.
+func LoadReleaseWithVerifier(in io.Reader, sig io.Reader, verifier ReleaseVerifier, options ReleaseOptions) (*Release, error) {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := ioutil.ReadAll(sig)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifier.VerifyDetached(data, signature); err != nil {
+		return nil, err
+	}
+	return options.decode(bytes.NewReader(data))
+}
+
+// }}}
+
 // LoadInReleaseFile {{{
 
 // Given a path to the InRelease file on the filesystem, and the OpenPGP keyring
@@ -240,6 +821,7 @@ func LoadInReleaseFile(path string, keyring *openpgp.EntityList) (*Release, erro
 	if err != nil {
 		return nil, err
 	}
+	defer fd.Close()
 
 	return LoadInRelease(fd, keyring)
 }
@@ -0,0 +1,384 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"pault.ag/go/debian/control"
+	"pault.ag/go/debian/dependency"
+)
+
+// Test Helpers {{{
+
+// Create a FileHash for the file named name, which is hashed as the (fake)
+// hash hash.
+func newTestFileHash(algorithm, name, hash string, size int64) control.FileHash {
+	return control.FileHash{
+		Algorithm: algorithm,
+		Hash:      hash,
+		Size:      size,
+		Filename:  name,
+	}
+}
+
+// Create a Release with a SHA256 and a SHA512 hash for each of count
+// indices, as large as the Release of a Suite with many Components and
+// Architectures.
+func newLargeTestRelease(tb testing.TB, count int) *Release {
+	tb.Helper()
+	release := Release{
+		Suite:      "unstable",
+		Codename:   "sid",
+		Components: []string{"main"},
+		Date:       "Tue, 02 Jan 2024 03:04:05 +0000",
+	}
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("main/binary-arch%d/Packages", i)
+		for _, h := range []control.FileHash{
+			newTestFileHash("sha256", name, strings.Repeat("aa", 32), int64(i)),
+			newTestFileHash("sha512", name, strings.Repeat("bb", 64), int64(i)),
+		} {
+			if err := release.AddHash(h); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+	return &release
+}
+
+// }}}
+
+// Encode {{{
+
+// Benchmark encoding a Release with 5000 hash entries once, as Engross does,
+// against encoding it once for each of Release and InRelease, as it used to.
+func BenchmarkReleaseEncode(b *testing.B) {
+	release := newLargeTestRelease(b, 5000)
+	for _, bench := range []struct {
+		name    string
+		encodes int
+	}{
+		{"Once", 1},
+		{"PerFile", 2},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < bench.encodes; j++ {
+					if _, err := encodeBytes(release); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// }}}
+
+// A Release with a hash block (SHA3-256) which Release has no field for.
+const testReleaseUnknownHash = `Origin: Debian
+Suite: unstable
+Codename: sid
+Date: Sat, 14 Oct 2023 08:51:37 UTC
+Architectures: amd64
+Components: main
+SHA256:
+ aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa 10 main/binary-amd64/Packages
+SHA3-256:
+ bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb 10 main/binary-amd64/Packages
+`
+
+func TestReleaseUnknownHashes(t *testing.T) {
+	release, err := decodeRelease(strings.NewReader(testReleaseUnknownHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := release.UnknownHashes()
+	if len(unknown) != 1 {
+		t.Fatalf("Release has %d unknown hash blocks, not 1: %v", len(unknown), unknown)
+	}
+	if !strings.Contains(unknown["SHA3-256"], strings.Repeat("b", 64)+" 10 main/binary-amd64/Packages") {
+		t.Errorf("SHA3-256 block is %q", unknown["SHA3-256"])
+	}
+
+	encoded, err := encodeBytes(release)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"\nSHA256:\n",
+		"\nSHA3-256:\n",
+		" " + strings.Repeat("b", 64) + " 10 main/binary-amd64/Packages\n",
+	} {
+		if !strings.Contains(string(encoded), line) {
+			t.Errorf("Encoded Release is missing %q:\n%s", line, encoded)
+		}
+	}
+}
+
+// }}}
+
+// Dates {{{
+
+func TestParseReleaseTime(t *testing.T) {
+	for _, test := range []struct {
+		source string
+		date   string
+		when   time.Time
+	}{
+		// dak, as used by Debian (deb.debian.org, security.debian.org).
+		{"Debian", "Sat, 14 Oct 2023 08:51:37 UTC",
+			time.Date(2023, time.October, 14, 8, 51, 37, 0, time.UTC)},
+		// Launchpad, as used by Ubuntu (archive.ubuntu.com, PPAs).
+		{"Ubuntu", "Thu, 21 Apr 2022 17:16:08 UTC",
+			time.Date(2022, time.April, 21, 17, 16, 8, 0, time.UTC)},
+		// This package, as well as reprepro, write RFC 1123 with a
+		// numeric zone.
+		{"go-archive", "Tue, 02 Jan 2024 03:04:05 +0000",
+			time.Date(2024, time.January, 2, 3, 4, 5, 0, time.UTC)},
+		// aptly doesn't pad the day of the month.
+		{"aptly", "Mon, 2 Oct 2023 14:25:33 UTC",
+			time.Date(2023, time.October, 2, 14, 25, 33, 0, time.UTC)},
+		// Some repositories write the zone both ways.
+		{"numeric and named zone", "Fri, 13 Oct 2023 16:02:13 +0200 (CEST)",
+			time.Date(2023, time.October, 13, 14, 2, 13, 0, time.UTC)},
+		// Some leave the day of the week out entirely.
+		{"no day of week", "13 Oct 2023 14:02:13 +0000",
+			time.Date(2023, time.October, 13, 14, 2, 13, 0, time.UTC)},
+		// Runs of whitespace are folded.
+		{"extra whitespace", "Sat,  14 Oct 2023   08:51:37 UTC",
+			time.Date(2023, time.October, 14, 8, 51, 37, 0, time.UTC)},
+	} {
+		when, err := parseReleaseTime(test.date)
+		if err != nil {
+			t.Errorf("%s: %s", test.source, err)
+			continue
+		}
+		if !when.Equal(test.when) {
+			t.Errorf("%s: %q was parsed as %s, not %s", test.source, test.date, when, test.when)
+		}
+	}
+
+	for _, date := range []string{"", "2023-10-14T08:51:37Z", "yesterday"} {
+		if _, err := parseReleaseTime(date); err == nil {
+			t.Errorf("%q was parsed as a date", date)
+		}
+	}
+}
+
+// }}}
+
+// Expiry {{{
+
+func TestReleaseExpiredError(t *testing.T) {
+	now := time.Date(2024, time.January, 9, 0, 0, 0, 0, time.UTC)
+	expired := "Suite: stable\nValid-Until: Mon, 08 Jan 2024 00:00:00 UTC\n"
+
+	_, loadErr := LoadReleaseWithOptions(
+		strings.NewReader(expired), strings.NewReader(""), nil,
+		ReleaseOptions{Clock: func() time.Time { return now }, RejectExpired: true},
+	)
+	downloader := Downloader{Clock: func() time.Time { return now }, RejectExpired: true}
+	release, err := decodeRelease(strings.NewReader(expired))
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloadErr := downloader.checkRelease("stable", release)
+
+	for name, err := range map[string]error{
+		"LoadReleaseWithOptions": loadErr,
+		"Downloader":             downloadErr,
+	} {
+		expiredErr := &ReleaseExpiredError{}
+		if !errors.As(err, &expiredErr) {
+			t.Errorf("%s returned %v, not a *ReleaseExpiredError", name, err)
+			continue
+		}
+		if !errors.Is(err, ErrReleaseExpired) {
+			t.Errorf("%s returned %v, which is not an ErrReleaseExpired", name, err)
+		}
+		if expiredErr.Suite != "stable" {
+			t.Errorf("%s returned an error for %q, not stable", name, expiredErr.Suite)
+		}
+	}
+}
+
+// }}}
+
+// Consistent {{{
+
+// A trimmed down copy of the Release of Debian bookworm, with the hashes and
+// sizes replaced, and only the amd64 and arm64 indices kept.
+const testReleaseBookworm = `Origin: Debian
+Label: Debian
+Suite: stable
+Version: 12.2
+Codename: bookworm
+Changelogs: https://metadata.ftp-master.debian.org/changelogs/@CHANGEPATH@_changelog
+Date: Sat, 07 Oct 2023 09:46:19 UTC
+Acquire-By-Hash: yes
+No-Support-for-Architecture-all: Packages
+Architectures: all amd64 arm64
+Components: main contrib non-free-firmware
+Description: Debian 12.2 Released 07 October 2023
+SHA256:
+ abababababababababababababababababababababababababababababababab 1000 main/binary-all/Packages
+ abababababababababababababababababababababababababababababababab 1001 main/binary-amd64/Packages
+ abababababababababababababababababababababababababababababababab 1002 main/binary-amd64/Packages.xz
+ abababababababababababababababababababababababababababababababab 1003 main/binary-arm64/Packages
+ abababababababababababababababababababababababababababababababab 1004 main/debian-installer/binary-amd64/Packages
+ abababababababababababababababababababababababababababababababab 1005 main/debian-installer/binary-amd64/Packages.xz
+ abababababababababababababababababababababababababababababababab 1006 main/debian-installer/binary-arm64/Packages
+ abababababababababababababababababababababababababababababababab 1007 main/dep11/Components-amd64.yml.xz
+ abababababababababababababababababababababababababababababababab 1008 main/i18n/Translation-en
+ abababababababababababababababababababababababababababababababab 1009 main/installer-amd64/current/images/SHA256SUMS
+ abababababababababababababababababababababababababababababababab 1010 main/source/Sources
+ abababababababababababababababababababababababababababababababab 1011 main/source/Sources.xz
+ abababababababababababababababababababababababababababababababab 1012 main/Contents-amd64
+ abababababababababababababababababababababababababababababababab 1013 contrib/binary-amd64/Packages
+ abababababababababababababababababababababababababababababababab 1014 contrib/binary-arm64/Packages
+ abababababababababababababababababababababababababababababababab 1015 contrib/debian-installer/binary-amd64/Packages
+ abababababababababababababababababababababababababababababababab 1016 contrib/source/Sources
+ abababababababababababababababababababababababababababababababab 1017 non-free-firmware/binary-amd64/Packages
+ abababababababababababababababababababababababababababababababab 1018 non-free-firmware/binary-arm64/Packages
+ abababababababababababababababababababababababababababababababab 1019 non-free-firmware/source/Sources
+`
+
+func TestReleaseConsistent(t *testing.T) {
+	release, err := decodeRelease(strings.NewReader(testReleaseBookworm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := release.Consistent(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReleaseInconsistent(t *testing.T) {
+	amd64, err := dependency.ParseArch("amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name       string
+		components []string
+		indices    []string
+	}{
+		{"undeclared component", []string{"main"}, []string{
+			"main/binary-amd64/Packages",
+			"contrib/binary-amd64/Packages",
+		}},
+		{"undeclared component with debian-installer", []string{"main"}, []string{
+			"main/binary-amd64/Packages",
+			"contrib/debian-installer/binary-amd64/Packages",
+		}},
+		{"undeclared architecture", []string{"main"}, []string{
+			"main/binary-amd64/Packages",
+			"main/debian-installer/binary-arm64/Packages",
+		}},
+		{"component without indices", []string{"main", "contrib"}, []string{
+			"main/binary-amd64/Packages",
+		}},
+	} {
+		release := Release{
+			Components:    test.components,
+			Architectures: []dependency.Arch{*amd64},
+		}
+		for _, index := range test.indices {
+			if err := release.AddHash(newTestFileHash("sha256", index, strings.Repeat("ab", 32), 10)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := release.Consistent(); err == nil {
+			t.Errorf("%s: Release is consistent", test.name)
+		}
+	}
+
+	// Components may have a "/" in them, such as on security mirrors.
+	release := Release{
+		Components:    []string{"updates/main"},
+		Architectures: []dependency.Arch{*amd64},
+	}
+	for _, index := range []string{
+		"updates/main/binary-amd64/Packages",
+		"updates/main/debian-installer/binary-amd64/Packages",
+	} {
+		if err := release.AddHash(newTestFileHash("sha256", index, strings.Repeat("ab", 32), 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := release.Consistent(); err != nil {
+		t.Error(err)
+	}
+}
+
+// }}}
+
+// AddHash {{{
+
+func TestAddHash(t *testing.T) {
+	release := Release{
+		// Entries which were not added with AddHash must be checked too.
+		SHA256: []control.SHA256FileHash{{
+			newTestFileHash("sha256", "main/binary-amd64/Packages", strings.Repeat("aa", 32), 10),
+		}},
+	}
+
+	for _, h := range []control.FileHash{
+		newTestFileHash("sha256", "main/binary-amd64/Packages", strings.Repeat("aa", 32), 10),
+		newTestFileHash("SHA256", "main/binary-amd64/Packages.gz", strings.Repeat("bb", 32), 5),
+		newTestFileHash("sha256", "main/binary-amd64/Packages.gz", strings.Repeat("bb", 32), 5),
+		newTestFileHash("md5", "main/binary-amd64/Packages.gz", strings.Repeat("cc", 16), 5),
+	} {
+		if err := release.AddHash(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(release.SHA256) != 2 || len(release.MD5Sum) != 1 {
+		t.Fatalf("Release has %d SHA256 and %d MD5Sum hashes, not 2 and 1",
+			len(release.SHA256), len(release.MD5Sum))
+	}
+
+	for _, h := range []control.FileHash{
+		newTestFileHash("sha256", "main/binary-amd64/Packages", strings.Repeat("dd", 32), 10),
+		newTestFileHash("sha256", "main/binary-amd64/Packages.gz", strings.Repeat("bb", 32), 6),
+	} {
+		if err := release.AddHash(h); err == nil {
+			t.Errorf("Conflicting hash for %s was added", h.Filename)
+		}
+	}
+
+	// Entries put into the hash block after AddHash was used are checked
+	// as well.
+	release.SHA256 = append(release.SHA256, control.SHA256FileHash{
+		newTestFileHash("sha256", "main/source/Sources", strings.Repeat("ee", 32), 7),
+	})
+	if err := release.AddHash(newTestFileHash(
+		"sha256", "main/source/Sources", strings.Repeat("ff", 32), 7,
+	)); err == nil {
+		t.Errorf("Conflicting hash for main/source/Sources was added")
+	}
+
+	if err := release.AddHash(newTestFileHash("sha384", "Contents-amd64", "00", 1)); err == nil {
+		t.Errorf("Hash with an unknown algorithm was added")
+	}
+}
+
+func BenchmarkAddHash(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		release := Release{}
+		for j := 0; j < 5000; j++ {
+			name := fmt.Sprintf("main/binary-arch%d/Packages", j)
+			if err := release.AddHash(newTestFileHash("sha256", name, strings.Repeat("aa", 32), 10)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
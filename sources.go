@@ -23,7 +23,9 @@ package archive
 import (
 	"fmt"
 	"io"
+	"iter"
 	"os"
+	"path"
 	"strings"
 
 	"pault.ag/go/debian/control"
@@ -64,6 +66,77 @@ func (sn *SourceName) MarshalControl() (string, error) {
 	return fmt.Sprintf("%s (%s)", sn.Name, sn.Version.String()), nil
 }
 
+// BinaryStanza {{{
+
+// A single line of the Package-List field of a Source, describing one of the
+// binary packages built by that Source, such as:
+//
+//	hello deb devel optional arch=any
+type BinaryStanza struct {
+	Name     string
+	Type     string
+	Section  string
+	Priority string
+
+	// Architectures set by the "arch=" key, if present.
+	Architectures []dependency.Arch
+
+	// Any other key=value pairs (such as "profile=" or "essential="), in the
+	// order they were given.
+	Options []string
+
+	// How many of the Options came before the "arch=" key, so that it's
+	// written back out in the same place. By default, it comes first.
+	archIndex int
+}
+
+func (b *BinaryStanza) UnmarshalControl(data string) error {
+	fields := strings.Fields(data)
+	if len(fields) < 4 {
+		return fmt.Errorf("Package-List entry is malformed: %s", data)
+	}
+	b.Name, b.Type, b.Section, b.Priority = fields[0], fields[1], fields[2], fields[3]
+
+	for _, option := range fields[4:] {
+		if !strings.HasPrefix(option, "arch=") {
+			b.Options = append(b.Options, option)
+			continue
+		}
+		b.archIndex = len(b.Options)
+		for _, name := range strings.Split(strings.TrimPrefix(option, "arch="), ",") {
+			arch, err := dependency.ParseArch(name)
+			if err != nil {
+				return err
+			}
+			b.Architectures = append(b.Architectures, *arch)
+		}
+	}
+	return nil
+}
+
+func (b BinaryStanza) MarshalControl() (string, error) {
+	fields := []string{b.Name, b.Type, b.Section, b.Priority}
+	if len(b.Architectures) == 0 {
+		fields = append(fields, b.Options...)
+		return strings.Join(fields, " "), nil
+	}
+
+	arches := []string{}
+	for _, arch := range b.Architectures {
+		arches = append(arches, arch.String())
+	}
+	archIndex := b.archIndex
+	if archIndex > len(b.Options) {
+		archIndex = len(b.Options)
+	}
+	fields = append(fields, b.Options[:archIndex]...)
+	fields = append(fields, "arch="+strings.Join(arches, ","))
+	fields = append(fields, b.Options[archIndex:]...)
+	return strings.Join(fields, " "), nil
+}
+
+// }}}
+
 // Source {{{
 
 // The files dists/$DIST/$COMP/source/Sources are called Sources indices. They
@@ -97,8 +170,8 @@ type Source struct {
 	Maintainer       string
 	Uploaders        []string
 	Homepage         string
-	StandardsVersion string   `control:"Standards-Version"`
-	PackageList      []string `control:"Package-List" delim:"\n" strip:" \t\n\r" multiline:"true"`
+	StandardsVersion string         `control:"Standards-Version"`
+	PackageList      []BinaryStanza `control:"Package-List" delim:"\n" strip:" \t\n\r" multiline:"true"`
 
 	ChecksumsSha1   []control.SHA1FileHash   `control:"Checksums-Sha1" delim:"\n" strip:" \t\n\r" multiline:"true"`
 	ChecksumsSha256 []control.SHA256FileHash `control:"Checksums-Sha256" delim:"\n" strip:" \t\n\r" multiline:"true"`
@@ -111,18 +184,271 @@ func (s Source) BuildDepends() (*dependency.Dependency, error) {
 	return dependency.Parse(s.Paragraph.Values["Build-Depends"])
 }
 
+// Get the build dependencies needed only to build the architecture dependent
+// binaries of this Source, from the Build-Depends-Arch field.
+func (s Source) BuildDependsArch() (*dependency.Dependency, error) {
+	return dependency.Parse(s.Paragraph.Values["Build-Depends-Arch"])
+}
+
+// Get the build dependencies needed only to build the architecture
+// independent binaries of this Source, from the Build-Depends-Indep field.
+func (s Source) BuildDependsIndep() (*dependency.Dependency, error) {
+	return dependency.Parse(s.Paragraph.Values["Build-Depends-Indep"])
+}
+
+// Get the packages which must not be installed to build this Source, from
+// the Build-Conflicts field.
+func (s Source) BuildConflicts() (*dependency.Dependency, error) {
+	return dependency.Parse(s.Paragraph.Values["Build-Conflicts"])
+}
+
+// Like BuildConflicts, but from the Build-Conflicts-Arch field.
+func (s Source) BuildConflictsArch() (*dependency.Dependency, error) {
+	return dependency.Parse(s.Paragraph.Values["Build-Conflicts-Arch"])
+}
+
+// Like BuildConflicts, but from the Build-Conflicts-Indep field.
+func (s Source) BuildConflictsIndep() (*dependency.Dependency, error) {
+	return dependency.Parse(s.Paragraph.Values["Build-Conflicts-Indep"])
+}
+
+// Get every build dependency of this Source, which is everything in
+// Build-Depends, Build-Depends-Arch and Build-Depends-Indep, as needed to
+// build all of its binaries.
+func (s Source) AllBuildDepends() (*dependency.Dependency, error) {
+	ret := dependency.Dependency{}
+	for _, get := range []func() (*dependency.Dependency, error){
+		s.BuildDepends, s.BuildDependsArch, s.BuildDependsIndep,
+	} {
+		depends, err := get()
+		if err != nil {
+			return nil, err
+		}
+		ret.Relations = append(ret.Relations, depends.Relations...)
+	}
+	return &ret, nil
+}
+
+// Get the paths (relative to the root of the archive) of every file of this
+// Source in the pool, as listed in its Files and Checksums-Sha256 fields,
+// without duplicates.
+func (s Source) PoolFiles() []string {
+	seen := map[string]bool{}
+	ret := []string{}
+	add := func(filename string) {
+		poolPath := path.Join(s.Directory, filename)
+		if seen[poolPath] {
+			return
+		}
+		seen[poolPath] = true
+		ret = append(ret, poolPath)
+	}
+	for _, file := range s.Files {
+		add(file.Filename)
+	}
+	for _, file := range s.ChecksumsSha256 {
+		add(file.Filename)
+	}
+	return ret
+}
+
+// Get the Architectures this Source should be built on, out of the
+// Architectures of a Suite, per its Architecture field. "any" (and other
+// wildcards, such as "linux-any") expand to every matching Architecture of
+// the Suite, explicit Architectures are kept only if the Suite has them, and
+// "all" (the architecture independent binaries, which are built only once)
+// is kept as "all", last. So, "any all" is every Architecture of the Suite,
+// plus "all".
+func (s Source) BuildArches(suiteArches []dependency.Arch) []dependency.Arch {
+	ret := []dependency.Arch{}
+	for _, suiteArch := range suiteArches {
+		if suiteArch.String() == dependency.All.String() {
+			continue
+		}
+		for _, declared := range s.Architectures {
+			if declared.String() == dependency.All.String() {
+				continue
+			}
+			if suiteArch.Is(&declared) {
+				ret = append(ret, suiteArch)
+				break
+			}
+		}
+	}
+	for _, declared := range s.Architectures {
+		if declared.String() == dependency.All.String() {
+			ret = append(ret, dependency.All)
+			break
+		}
+	}
+	return ret
+}
+
+// Get the URL of the Git repository the packaging of this Source is
+// maintained in, from the Vcs-Git field, if any.
+func (s Source) VcsGit() string {
+	return strings.TrimSpace(s.Paragraph.Values["Vcs-Git"])
+}
+
+// Get the URL of a web view of the repository the packaging of this Source is
+// maintained in, from the Vcs-Browser field, if any.
+func (s Source) VcsBrowser() string {
+	return strings.TrimSpace(s.Paragraph.Values["Vcs-Browser"])
+}
+
+// Get the list of test suites (such as "autopkgtest") declared by this
+// Source in the Testsuite field. This is empty if the Source declares no
+// test suites.
+func (s Source) Testsuite() []string {
+	return splitCommaList(s.Paragraph.Values["Testsuite"])
+}
+
+// Get the list of packages which trigger the test suites of this Source,
+// from the Testsuite-Triggers field.
+func (s Source) TestsuiteTriggers() []string {
+	return splitCommaList(s.Paragraph.Values["Testsuite-Triggers"])
+}
+
+// Split a comma separated field value into its entries, stripping
+// whitespace, and dropping any empty entries.
+func splitCommaList(value string) []string {
+	ret := []string{}
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			ret = append(ret, entry)
+		}
+	}
+	return ret
+}
+
+// Check to see if two Source entries are the same, ignoring the order of
+// fields and any cosmetic whitespace. Fields that exist only in the
+// underlying Paragraph are compared as well.
+func (s Source) Equal(other Source) bool {
+	return canonicalEqual(s.Paragraph, &s, other.Paragraph, &other)
+}
+
 // }}}
 
 // SourceFromDsc {{{
 
+// Create a Source entry for a Sources index from the .dsc of a source
+// package, which has been put in the pool at `directory`.
+//
+// The .dsc itself is listed in the Files and checksums of the Source, along
+// with the files it lists, as apt needs it to fetch and unpack the source
+// package. A .dsc with no Format is format "1.0", and the files it lists
+// must add up to a source package of that Format; see checkSourceFormat.
 func SourceFromDsc(dsc *control.DSC, directory string) (*Source, error) {
 	pkg := Source{}
 
+	if err := checkSourceFormat(dsc); err != nil {
+		return nil, err
+	}
+
 	paragraph := dsc.Paragraph
 	paragraph.Set("Directory", directory)
 	// paragraph.Set("Filename", debFile.Path)
 
-	return &pkg, control.UnpackFromParagraph(paragraph, &pkg)
+	if err := control.UnpackFromParagraph(paragraph, &pkg); err != nil {
+		return nil, err
+	}
+
+	if pkg.Package == "" {
+		pkg.Package = dsc.Source
+	}
+	if pkg.Format == "" {
+		pkg.Format = "1.0"
+	}
+
+	if dsc.Filename != "" {
+		if err := pkg.addDscHashes(dsc.Filename); err != nil {
+			return nil, err
+		}
+	}
+
+	return &pkg, nil
+}
+
+// Hash the .dsc file at dscPath, and list it in the Files, Checksums-Sha1
+// and Checksums-Sha256 of the Source.
+func (s *Source) addDscHashes(dscPath string) error {
+	fd, err := os.Open(dscPath)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	hashWriter, hashers, err := newHashers([]string{"md5", "sha1", "sha256"})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(hashWriter, fd); err != nil {
+		return err
+	}
+
+	name := path.Base(dscPath)
+	s.Files = append(s.Files, control.MD5FileHash{
+		FileHash: control.FileHashFromHasher(name, *hashers[0]),
+	})
+	s.ChecksumsSha1 = append(s.ChecksumsSha1, control.SHA1FileHash{
+		FileHash: control.FileHashFromHasher(name, *hashers[1]),
+	})
+	s.ChecksumsSha256 = append(s.ChecksumsSha256, control.SHA256FileHash{
+		FileHash: control.FileHashFromHasher(name, *hashers[2]),
+	})
+	return nil
+}
+
+// Check that the files listed in the .dsc add up to a source package of its
+// Format. A native source package ("3.0 (native)", or a "1.0" one without an
+// orig tarball) must be exactly one tarball, with no orig tarball, debian
+// tarball or diff; a "1.0" native tarball must also be gzip compressed.
+// Other formats aren't checked.
+func checkSourceFormat(dsc *control.DSC) error {
+	format := dsc.Format
+	if format == "" {
+		format = "1.0"
+	}
+
+	var tarballs, origs, others []string
+	for _, file := range dsc.Files {
+		name := path.Base(file.Filename)
+		switch {
+		case strings.HasSuffix(name, ".asc"):
+			// Upstream signatures don't change what the package is.
+		case strings.Contains(name, ".orig.tar.") || strings.Contains(name, ".orig-"):
+			origs = append(origs, name)
+		case strings.Contains(name, ".debian.tar.") || strings.HasSuffix(name, ".diff.gz"):
+			others = append(others, name)
+		case strings.Contains(name, ".tar."):
+			tarballs = append(tarballs, name)
+		default:
+			others = append(others, name)
+		}
+	}
+
+	switch {
+	case format == "3.0 (native)":
+	case format == "1.0" && len(origs) == 0:
+	default:
+		return nil
+	}
+
+	if len(origs) != 0 || len(others) != 0 || len(tarballs) != 1 {
+		return fmt.Errorf(
+			"Source %s is native (format %s), but is not exactly one tarball: %s",
+			dsc.Source, format,
+			strings.Join(append(append(tarballs, origs...), others...), ", "),
+		)
+	}
+	if format == "1.0" && !strings.HasSuffix(tarballs[0], ".tar.gz") {
+		return fmt.Errorf(
+			"Source %s is native (format 1.0), but %s is not a .tar.gz",
+			dsc.Source, tarballs[0],
+		)
+	}
+	return nil
 }
 
 // }}}
@@ -133,6 +459,10 @@ func SourceFromDsc(dsc *control.DSC, directory string) (*Source, error) {
 
 type Sources struct {
 	decoder *control.Decoder
+
+	// If set, called once by Close, or once Next returns io.EOF, to release
+	// whatever the Sources list is read from.
+	closer func() error
 }
 
 // Next {{{
@@ -141,7 +471,45 @@ type Sources struct {
 // io.EOF at the last entry.
 func (p *Sources) Next() (*Source, error) {
 	next := Source{}
-	return &next, p.decoder.Decode(&next)
+	err := p.decoder.Decode(&next)
+	if err == io.EOF {
+		if err := p.Close(); err != nil {
+			return &next, err
+		}
+	}
+	return &next, err
+}
+
+// Release whatever the Sources list is being read from, such as the
+// temporary file of ReleaseDownloader.Sources. This is done automatically
+// once Next returns io.EOF, so it's only needed if the Sources list is not
+// read to the end. It's safe to call more than once.
+func (p *Sources) Close() error {
+	if p.closer == nil {
+		return nil
+	}
+	closer := p.closer
+	p.closer = nil
+	return closer()
+}
+
+// Get an iterator over the rest of the Source entries in the Sources list,
+// for use with range, like Packages.All.
+func (p *Sources) All() iter.Seq2[*Source, error] {
+	return func(yield func(*Source, error) bool) {
+		for {
+			source, err := p.Next()
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(source, nil) {
+				return
+			}
+		}
+	}
 }
 
 // }}}
@@ -151,12 +519,21 @@ func (p *Sources) Next() (*Source, error) {
 // Given a path, create a Sources iterator. Note that the Sources
 // file is not OpenPGP signed, so one will need to verify the integrety
 // of this file from the InRelease file before trusting any output.
+//
+// The file is closed once the iterator returns io.EOF, or is closed with
+// Sources.Close.
 func LoadSourcesFile(path string) (*Sources, error) {
 	fd, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
-	return LoadSources(fd)
+	sources, err := LoadSources(fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	sources.closer = fd.Close
+	return sources, nil
 }
 
 // }}}
@@ -166,6 +543,9 @@ func LoadSourcesFile(path string) (*Sources, error) {
 // Given an io.Reader, create a Sources iterator. Note that the Sources
 // file is not OpenPGP signed, so one will need to verify the integrety
 // of this file from the InRelease file before trusting any output.
+//
+// in is never closed by the iterator, even if it's an io.Closer; that's up to
+// the caller.
 func LoadSources(in io.Reader) (*Sources, error) {
 	decoder, err := control.NewDecoder(in, nil)
 	if err != nil {
@@ -0,0 +1,143 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"pault.ag/go/debian/control"
+)
+
+// BinaryStanza {{{
+
+func TestBinaryStanzaRoundTrip(t *testing.T) {
+	for _, line := range []string{
+		"hello deb devel optional",
+		"hello deb devel optional arch=any",
+		"hello deb devel optional arch=amd64,arm64 profile=!nocheck",
+		"hello deb devel optional profile=!nocheck arch=any",
+		"hello deb devel optional essential=yes profile=!nocheck arch=any",
+		"hello udeb debian-installer optional profile=!stage1 arch=linux-any essential=yes",
+	} {
+		stanza := BinaryStanza{}
+		if err := stanza.UnmarshalControl(line); err != nil {
+			t.Fatalf("%s: %s", line, err)
+		}
+		marshaled, err := stanza.MarshalControl()
+		if err != nil {
+			t.Fatalf("%s: %s", line, err)
+		}
+		if marshaled != line {
+			t.Errorf("%q was written back out as %q", line, marshaled)
+		}
+	}
+}
+
+// }}}
+
+// Native Sources {{{
+
+// Write a "3.0 (native)" source package for hello into dir, returning the
+// path of its .dsc.
+func writeNativeSource(t testing.TB, dir string) string {
+	t.Helper()
+	tarball := bytes.Repeat([]byte("hello world\n"), 100)
+	if err := ioutil.WriteFile(filepath.Join(dir, "hello_1.0.tar.xz"), tarball, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sha := sha256.Sum256(tarball)
+	md := md5.Sum(tarball)
+
+	dsc := fmt.Sprintf(`Format: 3.0 (native)
+Source: hello
+Binary: hello
+Architecture: any
+Version: 1.0
+Maintainer: Test Maintainer <maintainer@example.com>
+Checksums-Sha256:
+ %x %d hello_1.0.tar.xz
+Files:
+ %x %d hello_1.0.tar.xz
+`, sha, len(tarball), md, len(tarball))
+	dscPath := filepath.Join(dir, "hello_1.0.dsc")
+	if err := ioutil.WriteFile(dscPath, []byte(dsc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dscPath
+}
+
+func TestNativeSourceRoundTrip(t *testing.T) {
+	a := newTestArchive(t)
+	suite, err := a.Suite("unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	component, err := suite.Component("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dsc, err := control.ParseDscFile(writeNativeSource(t, t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	directory, included, err := component.Pool().IncludeSources(dsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := SourceFromDsc(dsc, directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := component.AddSource(*source); err != nil {
+		t.Fatal(err)
+	}
+
+	files := engrossTestSuite(t, a, suite)
+	obj, ok := files[suiteFilePath("unstable", "main/source/Sources")]
+	if !ok {
+		t.Fatalf("No Sources index was written")
+	}
+	sources, err := LoadSources(bytes.NewReader(readObject(t, a, obj)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := sources.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.Package != "hello" || loaded.Format != "3.0 (native)" {
+		t.Errorf("Loaded %s, format %s", loaded.Package, loaded.Format)
+	}
+	if loaded.Directory != "pool/main/h/hello" {
+		t.Errorf("Directory is %s, not pool/main/h/hello", loaded.Directory)
+	}
+
+	// apt fetches the .dsc and the tarball, and nothing else.
+	names := []string{}
+	for _, file := range loaded.ChecksumsSha256 {
+		names = append(names, file.Filename)
+		if _, ok := included[path.Join(loaded.Directory, file.Filename)]; !ok {
+			t.Errorf("%s was not included into the pool", file.Filename)
+		}
+	}
+	sort.Strings(names)
+	if strings.Join(names, " ") != "hello_1.0.dsc hello_1.0.tar.xz" {
+		t.Errorf("Sources entry lists %v", names)
+	}
+	if len(loaded.Files) != 2 {
+		t.Errorf("Sources entry lists %d Files, not 2", len(loaded.Files))
+	}
+}
+
+// }}}
+
+// vim: foldmethod=marker
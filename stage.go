@@ -0,0 +1,94 @@
+package archive
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Stage {{{
+
+// A signed, engrossed Suite which has been set aside in a staging area of
+// the Archive, rather than being linked into place, so that it can be
+// reviewed before being published with Commit, or thrown away with Discard.
+type StagedRelease struct {
+	archive *Archive
+	dir     string
+
+	// Files that will be linked into place by Commit.
+	Files ArchiveState
+
+	// Text of the signed Release, for review. This is the clearsigned
+	// InRelease if the Suite writes one, or the Release file otherwise.
+	Release []byte
+}
+
+// Engross a Suite, like Engross, but rather than returning the files to be
+// linked into place, link them into "staging/<suite>" in the Archive, where
+// they're safe from garbage collection, but not published.
+//
+// The StagedRelease returned contains the signed Release for review, and can
+// be used to publish the Suite (with Commit) or drop it (with Discard).
+func (a Archive) Stage(suite Suite) (*StagedRelease, error) {
+	files, err := a.Engross(suite)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := path.Join("staging", suite.Name)
+	if err := os.RemoveAll(filepath.Join(a.path, dir)); err != nil {
+		return nil, err
+	}
+	for filePath, obj := range files {
+		if err := a.Store.Link(obj, path.Join(dir, filePath)); err != nil {
+			return nil, err
+		}
+	}
+
+	release, ok := files[suiteFilePath(suite.Name, "InRelease")]
+	if !ok {
+		release, ok = files[suiteFilePath(suite.Name, "Release")]
+	}
+	if !ok {
+		return nil, fmt.Errorf("No Release was written for '%s'", suite.Name)
+	}
+
+	fd, err := a.Store.Open(release)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	text, err := ioutil.ReadAll(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StagedRelease{
+		archive: &a,
+		dir:     dir,
+		Files:   files,
+		Release: text,
+	}, nil
+}
+
+// Publish the staged Suite, by linking its files into their live paths, and
+// removing the staging area.
+func (s *StagedRelease) Commit() error {
+	if err := s.archive.Link(s.Files); err != nil {
+		return err
+	}
+	return s.Discard()
+}
+
+// Drop the staged Suite, by removing the staging area. The files will be
+// removed from the blobstore by the next GC, unless they're linked elsewhere.
+func (s *StagedRelease) Discard() error {
+	return os.RemoveAll(filepath.Join(s.archive.path, s.dir))
+}
+
+// }}}
+
+// vim: foldmethod=marker
@@ -0,0 +1,184 @@
+package archive
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"pault.ag/go/debian/control"
+	"pault.ag/go/debian/dependency"
+)
+
+// Translation {{{
+
+// A single entry of a Translation-<lang> index (such as
+// "main/i18n/Translation-en"), which holds the long Description of a binary
+// package in one language, keyed by the Description-md5 of the Package.
+type Translation struct {
+	control.Paragraph
+
+	Package        string `required:"true"`
+	DescriptionMD5 string `control:"Description-md5" required:"true"`
+
+	// Language of the Description, and the Description itself, from the
+	// Description-<lang> field of the entry (such as Description-en).
+	Language    string `control:"-"`
+	Description string `control:"-"`
+}
+
+// Translation entry as written by Engross into the Translation-en index.
+type englishTranslation struct {
+	Package        string
+	DescriptionMD5 string `control:"Description-md5"`
+	Description    string `control:"Description-en"`
+}
+
+// Get the path of the Translation index for the given Component and
+// language, relative to the directory of the Suite (such as
+// "main/i18n/Translation-en").
+func translationPath(component, lang string) string {
+	return path.Join(component, "i18n", fmt.Sprintf("Translation-%s", lang))
+}
+
+// Compute the Description-md5 of a Description, which is the MD5 of the
+// Description as it's written in the Packages file (continuation lines
+// indented, and empty lines as " ."), followed by a newline; this is the
+// same as dak and apt compute it.
+func descriptionMD5(description string) string {
+	description = strings.Replace(description, "\n", "\n ", -1)
+	description = strings.Replace(description, "\n \n", "\n .\n", -1)
+	return fmt.Sprintf("%x", md5.Sum([]byte(description+"\n")))
+}
+
+// Get the english Translation entries for the Packages in the given
+// IndexWriters (one for each distinct Package and Description-md5), sorted
+// by Package.
+func englishTranslations(writers map[dependency.Arch]*IndexWriter) []englishTranslation {
+	seen := map[string]bool{}
+	ret := []englishTranslation{}
+	for _, writer := range writers {
+		for _, data := range writer.entries {
+			pkg, ok := data.(Package)
+			if !ok || pkg.DescriptionMD5 == "" {
+				continue
+			}
+			key := pkg.Package + " " + pkg.DescriptionMD5
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			ret = append(ret, englishTranslation{
+				Package:        pkg.Package,
+				DescriptionMD5: pkg.DescriptionMD5,
+				Description:    pkg.Description,
+			})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Package != ret[j].Package {
+			return ret[i].Package < ret[j].Package
+		}
+		return ret[i].DescriptionMD5 < ret[j].DescriptionMD5
+	})
+	return ret
+}
+
+// }}}
+
+// Translations {{{
+
+// Iterator over the entries of a Translation-<lang> index.
+type Translations struct {
+	reader *control.ParagraphReader
+
+	// If set, called once by Close, or once Next returns io.EOF, to release
+	// whatever the Translation index is read from.
+	closer func() error
+}
+
+// Release whatever the Translation index is being read from, such as the
+// file opened by LoadTranslationsFile. This is done automatically once Next
+// returns io.EOF, so it's only needed if it is not read to the end. It's
+// safe to call more than once.
+func (t *Translations) Close() error {
+	if t.closer == nil {
+		return nil
+	}
+	closer := t.closer
+	t.closer = nil
+	return closer()
+}
+
+// Get the next Translation entry in the Translation index. This will return
+// an io.EOF at the last entry.
+func (t *Translations) Next() (*Translation, error) {
+	next := Translation{}
+	paragraph, err := t.reader.Next()
+	if err == io.EOF {
+		if err := t.Close(); err != nil {
+			return &next, err
+		}
+	}
+	if err != nil {
+		return &next, err
+	}
+	if err := control.UnpackFromParagraph(*paragraph, &next); err != nil {
+		return &next, err
+	}
+	for _, key := range paragraph.Order {
+		if strings.HasPrefix(key, "Description-") && key != "Description-md5" {
+			next.Language = strings.TrimPrefix(key, "Description-")
+			next.Description = paragraph.Values[key]
+			break
+		}
+	}
+	return &next, nil
+}
+
+// }}}
+
+// LoadTranslationsFile {{{
+
+// Given a path, create a Translations iterator. Note that the Translation
+// file is not OpenPGP signed, so one will need to verify the integrety of
+// this file from the InRelease file before trusting any output.
+//
+// The file is closed once the iterator returns io.EOF, or is closed with
+// Translations.Close.
+func LoadTranslationsFile(path string) (*Translations, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	translations, err := LoadTranslations(fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	translations.closer = fd.Close
+	return translations, nil
+}
+
+// }}}
+
+// LoadTranslations {{{
+
+// Given an io.Reader, create a Translations iterator. Note that the
+// Translation file is not OpenPGP signed, so one will need to verify the
+// integrety of this file from the InRelease file before trusting any
+// output.
+func LoadTranslations(in io.Reader) (*Translations, error) {
+	reader, err := control.NewParagraphReader(in, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Translations{reader: reader}, nil
+}
+
+// }}}
+
+// vim: foldmethod=marker
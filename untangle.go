@@ -2,16 +2,24 @@ package archive
 
 import (
 	"fmt"
-	"io"
 	"sort"
 
 	"pault.ag/go/debian/dependency"
 	"pault.ag/go/debian/version"
 )
 
+// Sort Packages by Version, newest first. Packages with the same Version are
+// sorted by Architecture, and then by name, so the order doesn't depend on
+// the order the Packages were read in.
 func SortPackages(packages []Package) []Package {
-	sort.Slice(packages, func(i, j int) bool {
-		return version.Compare(packages[i].Version, packages[j].Version) > 0
+	sort.SliceStable(packages, func(i, j int) bool {
+		if cmp := version.Compare(packages[i].Version, packages[j].Version); cmp != 0 {
+			return cmp > 0
+		}
+		if a, b := packages[i].Architecture.String(), packages[j].Architecture.String(); a != b {
+			return a < b
+		}
+		return packages[i].Package < packages[j].Package
 	})
 	return packages
 }
@@ -27,17 +35,123 @@ type PackageMap map[string][]Package
 
 func LoadPackageMap(binaries Packages) (*PackageMap, error) {
 	ret := PackageMap{}
+	if err := ret.Load(binaries); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// Load all the entries from binaries into the PackageMap, alongside any
+// that are already there. This can be used with LoadComponentPackages to
+// build a PackageMap covering many Components.
+func (p PackageMap) Load(binaries Packages) error {
+	for binary, err := range binaries.All() {
+		if err != nil {
+			return err
+		}
+		p[binary.Package] = SortPackages(append(p[binary.Package], *binary))
+	}
+	return nil
+}
 
-	for {
-		binary, err := binaries.Next()
-		if err == io.EOF {
-			break
-		} else if err != nil {
+// Get the list of Components which provide a Package with the given name.
+// This is only known for Packages loaded with LoadComponentPackages.
+func (p PackageMap) Components(name string) []string {
+	seen := map[string]bool{}
+	ret := []string{}
+	for _, pkg := range p[name] {
+		if pkg.Component == "" || seen[pkg.Component] {
+			continue
+		}
+		seen[pkg.Component] = true
+		ret = append(ret, pkg.Component)
+	}
+	return ret
+}
+
+// Get the index (into the list of Packages for possi.Name) of the first
+// Package which satisfies the given binary dependency Possibility. This
+// honors the version relation of the Possibility, if any, and its Arch, if
+// set, which Packages with the Architecture "all" always satisfy. Since the
+// list is sorted newest first, this is the newest Package that satisfies it.
+func (p PackageMap) Matches(possi dependency.Possibility) (int, error) {
+	candidates := p[possi.Name]
+	if len(candidates) == 0 {
+		return -1, fmt.Errorf("I have no idea what that package is!")
+	}
+	for i, candidate := range candidates {
+		if possi.Arch != nil && candidate.Architecture.String() != "all" &&
+			!possi.Arch.Is(&candidate.Architecture) {
+			continue
+		}
+		if possi.Version != nil && !possi.Version.SatisfiedBy(candidate.Version) {
+			continue
+		}
+		return i, nil
+	}
+	return -1, fmt.Errorf("No satisfactory dependency found")
+}
+
+// Get every binary Package in the PackageMap which was built from the given
+// Source, matching on the Source field of the Package (or the Package name,
+// if the Source field is not set). Binaries of every version are returned,
+// so comparing the Version (or Source.Version, if set) of each against the
+// Version of src will show which binaries are out of date.
+func BinariesForSource(src Source, pkgs PackageMap) []Package {
+	names := []string{}
+	for name := range pkgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ret := []Package{}
+	for _, name := range names {
+		for _, pkg := range pkgs[name] {
+			sourceName := pkg.Source.Name
+			if sourceName == "" {
+				sourceName = pkg.Package
+			}
+			if sourceName == src.Package {
+				ret = append(ret, pkg)
+			}
+		}
+	}
+	return ret
+}
+
+// Compact index of which Packages are in a Packages index, and the latest
+// Version of each, built with BuildPackageIndex. Unlike a PackageMap, this
+// keeps only the name and one Version per Package, so it's cheap to hold on
+// to for answering many "is this Package there" queries.
+type PackageIndex map[string]version.Version
+
+// Read every entry out of the Packages iterator, keeping only the newest
+// Version of each Package by name.
+func BuildPackageIndex(p *Packages) (PackageIndex, error) {
+	ret := PackageIndex{}
+	for pkg, err := range p.All() {
+		if err != nil {
 			return nil, err
 		}
-		ret[binary.Package] = SortPackages(append(ret[binary.Package], *binary))
+		if latest, ok := ret[pkg.Package]; ok && version.Compare(latest, pkg.Version) >= 0 {
+			continue
+		}
+		ret[pkg.Package] = pkg.Version
 	}
-	return &ret, nil
+	return ret, nil
+}
+
+// Check if there's a Package with the given name in the index.
+func (p PackageIndex) Has(name string) bool {
+	_, ok := p[name]
+	return ok
+}
+
+// Get the newest Version of the Package with the given name, and whether
+// there's such a Package in the index at all.
+func (p PackageIndex) LatestVersion(name string) (version.Version, bool) {
+	ver, ok := p[name]
+	return ver, ok
 }
 
 type SourceMap map[string][]Source
@@ -45,11 +159,8 @@ type SourceMap map[string][]Source
 func LoadSourceMap(sources Sources) (*SourceMap, error) {
 	ret := SourceMap{}
 
-	for {
-		source, err := sources.Next()
-		if err == io.EOF {
-			break
-		} else if err != nil {
+	for source, err := range sources.All() {
+		if err != nil {
 			return nil, err
 		}
 		ret[source.Package] = SortSources(append(ret[source.Package], *source))